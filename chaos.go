@@ -0,0 +1,146 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// ChaosConfig configures the randomized chaos schedule.
+type ChaosConfig struct {
+	// Seed is used by PRNG. Zero means a seed from current time. The seed
+	// is always logged so that the sequence can be replayed.
+	Seed int64
+	// Faults are the candidates picked randomly. Only features and ranges
+	// are used. The intervals are decided by chaos. Default is error_writes.
+	Faults []FaultSpec
+	// MinFault and MaxFault bound how long each fault lasts. Default is
+	// [1s, 10s].
+	MinFault, MaxFault time.Duration
+	// MinGap and MaxGap bound the healthy gap before each fault. Default
+	// is [1s, 30s].
+	MinGap, MaxGap time.Duration
+	// Logf logs the seed and each step. Default is log.Printf.
+	Logf func(format string, args ...any)
+}
+
+// withDefaults returns config with defaults and resolved seed.
+func (cfg ChaosConfig) withDefaults() (ChaosConfig, error) {
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	if len(cfg.Faults) == 0 {
+		cfg.Faults = []FaultSpec{{Features: []Feature{ErrorWritesFeature{}}}}
+	}
+	if cfg.MinFault == 0 && cfg.MaxFault == 0 {
+		cfg.MinFault, cfg.MaxFault = time.Second, 10*time.Second
+	}
+	if cfg.MinGap == 0 && cfg.MaxGap == 0 {
+		cfg.MinGap, cfg.MaxGap = time.Second, 30*time.Second
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = log.Printf
+	}
+
+	if cfg.MinFault <= 0 || cfg.MaxFault < cfg.MinFault {
+		return cfg, fmt.Errorf("invalid fault duration range [%v, %v]", cfg.MinFault, cfg.MaxFault)
+	}
+	if cfg.MinGap <= 0 || cfg.MaxGap < cfg.MinGap {
+		return cfg, fmt.Errorf("invalid gap duration range [%v, %v]", cfg.MinGap, cfg.MaxGap)
+	}
+
+	for i, fault := range cfg.Faults {
+		if _, err := chaosFaultSpec(fault, cfg.MinFault); err != nil {
+			return cfg, fmt.Errorf("invalid fault %d: %w", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// chaosFaultSpec returns the steady spec of fault lasting for d.
+func chaosFaultSpec(fault FaultSpec, d time.Duration) (FaultSpec, error) {
+	return steadySpec(FaultSpec{
+		DownInterval: d,
+		Features:     fault.Features,
+		Ranges:       fault.Ranges,
+		Excludes:     fault.Excludes,
+	})
+}
+
+// chaosSteps returns the generator of steps. Each fault is preceded by a
+// healthy gap, like gap, fault, gap, fault and so on.
+func (cfg ChaosConfig) chaosSteps() func(int) (ScheduleStep, bool) {
+	var (
+		rnd    = rand.New(rand.NewSource(cfg.Seed))
+		offset time.Duration
+	)
+
+	between := func(min, max time.Duration) time.Duration {
+		// millisecond granularity is enough for reload
+		return min + time.Duration(rnd.Int63n(int64((max-min)/time.Millisecond)+1))*time.Millisecond
+	}
+
+	return func(i int) (ScheduleStep, bool) {
+		var (
+			spec FaultSpec
+			d    time.Duration
+		)
+
+		if i%2 == 0 {
+			d = between(cfg.MinGap, cfg.MaxGap)
+			spec, _ = steadySpec(FaultSpec{UpInterval: d})
+		} else {
+			fault := cfg.Faults[rnd.Intn(len(cfg.Faults))]
+			d = between(cfg.MinFault, cfg.MaxFault)
+			spec, _ = chaosFaultSpec(fault, d)
+		}
+
+		step := ScheduleStep{Offset: offset, Spec: spec}
+		cfg.Logf("dmflakey: chaos (seed %d) step %d at %v: %s for %v", cfg.Seed, i, offset, spec, d)
+
+		offset += d
+		return step, true
+	}
+}
+
+// ChaosSteps returns the first n steps generated by config. The same seed
+// always generates the same steps.
+func ChaosSteps(cfg ChaosConfig, n int) ([]ScheduleStep, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Logf = func(string, ...any) {}
+
+	next := cfg.chaosSteps()
+
+	steps := make([]ScheduleStep, 0, n)
+	for i := 0; i < n; i++ {
+		step, _ := next(i)
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// StartChaos applies faults with random durations and healthy gaps picked
+// from seeded PRNG until the context is canceled or one reload fails. The
+// device might stay in fault after chaos stops, so call AllowWrites after Wait
+// to restore it.
+//
+// Only WithSyncFSFeatOpt takes effect. The context is also used to abort the
+// in-flight transition.
+func StartChaos(ctx context.Context, f Flakey, cfg ChaosConfig, opts ...FeatOpt) (*Schedule, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Logf("dmflakey: chaos seed %d", cfg.Seed)
+
+	s := newSchedule()
+	go s.run(ctx, f, cfg.chaosSteps(), opts...)
+	return s, nil
+}
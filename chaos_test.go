@@ -0,0 +1,105 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaosSteps(t *testing.T) {
+	cfg := ChaosConfig{
+		Seed: 20231114,
+		Faults: []FaultSpec{
+			{Features: []Feature{ErrorWritesFeature{}}},
+			{Features: []Feature{DropWritesFeature{}}},
+			{Features: []Feature{ErrorReadsFeature{}}, Ranges: []SectorRange{{Start: 0, Length: 8}}},
+		},
+		MinFault: 100 * time.Millisecond,
+		MaxFault: 5 * time.Second,
+		MinGap:   time.Second,
+		MaxGap:   10 * time.Second,
+	}
+
+	steps, err := ChaosSteps(cfg, 100)
+	require.NoError(t, err)
+	require.Len(t, steps, 100)
+
+	// same seed, same sequence
+	replayed, err := ChaosSteps(cfg, 100)
+	require.NoError(t, err)
+	assert.Equal(t, steps, replayed)
+
+	cfg.Seed++
+	other, err := ChaosSteps(cfg, 100)
+	require.NoError(t, err)
+	assert.NotEqual(t, steps, other)
+
+	var last time.Duration
+	for i, step := range steps {
+		assert.True(t, step.Offset >= last, "step %d goes back", i)
+		last = step.Offset
+
+		if i%2 == 0 {
+			assert.Empty(t, step.Spec.Features, "step %d should be healthy gap", i)
+			assert.Zero(t, step.Spec.DownInterval)
+			continue
+		}
+		assert.NotEmpty(t, step.Spec.Features, "step %d should be fault", i)
+		assert.Zero(t, step.Spec.UpInterval)
+		_, err := step.Spec.args()
+		assert.NoError(t, err)
+	}
+}
+
+func TestChaosInvalidConfig(t *testing.T) {
+	for _, cfg := range []ChaosConfig{
+		{MinFault: time.Second, MaxFault: time.Millisecond},
+		{MinGap: -time.Second, MaxGap: time.Second},
+		{Faults: []FaultSpec{{Features: []Feature{DropWritesFeature{}, ErrorWritesFeature{}}}}},
+	} {
+		_, err := ChaosSteps(cfg, 1)
+		assert.Error(t, err)
+	}
+}
+
+func TestStartChaos(t *testing.T) {
+	f := &recordFlakey{}
+
+	var logs []string
+	cfg := ChaosConfig{
+		Seed:     42,
+		MinFault: time.Millisecond,
+		MaxFault: 10 * time.Millisecond,
+		MinGap:   time.Millisecond,
+		MaxGap:   10 * time.Millisecond,
+		Logf: func(format string, args ...any) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	s, err := StartChaos(ctx, f, cfg)
+	require.NoError(t, err)
+
+	events, err := s.Wait()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotEmpty(t, events)
+	assert.Equal(t, "dmflakey: chaos seed 42", logs[0])
+
+	// the reloads are the same as the generated steps
+	steps, err := ChaosSteps(cfg, len(events))
+	require.NoError(t, err)
+
+	applied := f.specs()
+	for i, step := range steps {
+		assert.Equal(t, step.Spec, applied[i], "step %d", i)
+	}
+}
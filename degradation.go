@@ -0,0 +1,305 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DegradationStage is the stage of progressive disk degradation.
+type DegradationStage int
+
+// Degradation stages in order.
+const (
+	// StageReadCorrupt corrupts read bio occasionally. The probability
+	// ramps up to MaxCorruptProbability.
+	StageReadCorrupt DegradationStage = iota + 1
+	// StageReadErrors fails read I/O in growing part of each cycle.
+	StageReadErrors
+	// StageWriteErrors fails both read and write I/O in growing part of
+	// each cycle.
+	StageWriteErrors
+	// StageOffline fails all the I/O.
+	StageOffline
+)
+
+// String returns the stage name.
+func (s DegradationStage) String() string {
+	switch s {
+	case StageReadCorrupt:
+		return "read-corrupt"
+	case StageReadErrors:
+		return "read-errors"
+	case StageWriteErrors:
+		return "write-errors"
+	case StageOffline:
+		return "offline"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// DegradationCurve decides how fast the disk degrades.
+type DegradationCurve string
+
+// Supported degradation curves.
+const (
+	// CurveLinear degrades at constant speed over Duration.
+	CurveLinear DegradationCurve = "linear"
+	// CurveExponential degrades slowly at the beginning and then fast,
+	// reaching offline at Duration.
+	CurveExponential DegradationCurve = "exponential"
+	// CurveMarkov moves to the next stage with TransitionProbability at
+	// each tick. It's driven by seeded PRNG.
+	CurveMarkov DegradationCurve = "markov"
+)
+
+// exponentialRate is the growth rate of CurveExponential.
+const exponentialRate = 4
+
+// DegradationConfig configures the progressive degradation model.
+type DegradationConfig struct {
+	// Curve is the degradation curve. Default is CurveLinear.
+	Curve DegradationCurve
+	// Duration is how long the disk takes from healthy to offline for
+	// CurveLinear and CurveExponential. Default is 10 minutes.
+	Duration time.Duration
+	// Tick is how often the fault is re-evaluated and reloaded. It must not
+	// be less than Cycle. Default is 10 seconds.
+	Tick time.Duration
+	// Cycle is the up and down cycle in error stages. It must be at least 2
+	// seconds. Default is 10 seconds.
+	Cycle time.Duration
+	// MaxCorruptProbability is the random_read_corrupt probability at the
+	// end of StageReadCorrupt. Default is MaxProbability / 1000.
+	MaxCorruptProbability int
+	// Seed is used by CurveMarkov. Zero means a seed from current time.
+	Seed int64
+	// TransitionProbability is the probability moving to the next stage at
+	// each tick for CurveMarkov. Default is 0.1.
+	TransitionProbability float64
+	// Logf logs each step. Default is log.Printf.
+	Logf func(format string, args ...any)
+}
+
+// withDefaults returns config with defaults.
+func (cfg DegradationConfig) withDefaults() (DegradationConfig, error) {
+	if cfg.Curve == "" {
+		cfg.Curve = CurveLinear
+	}
+	if cfg.Duration == 0 {
+		cfg.Duration = 10 * time.Minute
+	}
+	if cfg.Tick == 0 {
+		cfg.Tick = 10 * time.Second
+	}
+	if cfg.Cycle == 0 {
+		cfg.Cycle = 10 * time.Second
+	}
+	if cfg.MaxCorruptProbability == 0 {
+		cfg.MaxCorruptProbability = MaxProbability / 1000
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	if cfg.TransitionProbability == 0 {
+		cfg.TransitionProbability = 0.1
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = log.Printf
+	}
+
+	switch cfg.Curve {
+	case CurveLinear, CurveExponential, CurveMarkov:
+	default:
+		return cfg, fmt.Errorf("unsupported degradation curve %q", cfg.Curve)
+	}
+
+	switch {
+	case cfg.Duration < 0:
+		return cfg, fmt.Errorf("invalid negative duration %v", cfg.Duration)
+	case cfg.Cycle < 2*time.Second:
+		return cfg, fmt.Errorf("cycle %v must be at least 2s", cfg.Cycle)
+	case cfg.Tick < cfg.Cycle:
+		return cfg, fmt.Errorf("tick %v must not be less than cycle %v", cfg.Tick, cfg.Cycle)
+	case cfg.TransitionProbability < 0 || cfg.TransitionProbability > 1:
+		return cfg, fmt.Errorf("invalid transition probability %v", cfg.TransitionProbability)
+	}
+	return cfg, validateProbability(RandomReadCorruptFeature{}.Name(), cfg.MaxCorruptProbability)
+}
+
+// DegradationState is the state of the disk at one tick.
+type DegradationState struct {
+	Stage DegradationStage
+	// Intensity is in [0, 1] within the stage.
+	Intensity float64
+}
+
+// states returns the generator of states. The generator returns false after
+// StageOffline.
+func (cfg DegradationConfig) states() func(int) (DegradationState, bool) {
+	ticks := int(cfg.Duration / cfg.Tick)
+
+	// severity maps the whole degradation to [0, 1]. One means offline.
+	severity := func(i int) float64 {
+		if ticks == 0 {
+			return 1
+		}
+
+		u := math.Min(float64(i)/float64(ticks), 1)
+		if cfg.Curve == CurveExponential {
+			return (math.Exp(exponentialRate*u) - 1) / (math.Exp(exponentialRate) - 1)
+		}
+		return u
+	}
+
+	var (
+		rnd     = rand.New(rand.NewSource(cfg.Seed))
+		stage   = StageReadCorrupt
+		inStage int
+		done    bool
+	)
+
+	return func(i int) (DegradationState, bool) {
+		if done {
+			return DegradationState{}, false
+		}
+
+		var state DegradationState
+		if cfg.Curve == CurveMarkov {
+			if i > 0 && rnd.Float64() < cfg.TransitionProbability {
+				stage, inStage = stage+1, 0
+			}
+			state = DegradationState{
+				Stage:     stage,
+				Intensity: math.Min(float64(inStage)*cfg.TransitionProbability, 1),
+			}
+			inStage++
+		} else {
+			s := severity(i) * float64(StageOffline-StageReadCorrupt)
+			state = DegradationState{
+				Stage:     StageReadCorrupt + DegradationStage(s),
+				Intensity: s - math.Floor(s),
+			}
+		}
+
+		if state.Stage >= StageOffline {
+			state, done = DegradationState{Stage: StageOffline, Intensity: 1}, true
+		}
+		return state, true
+	}
+}
+
+// spec returns the fault spec for the state.
+func (cfg DegradationConfig) spec(state DegradationState) FaultSpec {
+	switch state.Stage {
+	case StageReadCorrupt:
+		probability := int(float64(cfg.MaxCorruptProbability) * state.Intensity)
+		if probability < 1 {
+			probability = 1
+		}
+		return FaultSpec{
+			DownInterval: cfg.Tick,
+			Features:     []Feature{RandomReadCorruptFeature{Probability: probability}},
+		}
+	case StageReadErrors, StageWriteErrors:
+		cycle := int(cfg.Cycle / time.Second)
+
+		down := int(math.Round(state.Intensity * float64(cycle)))
+		if down < 1 {
+			down = 1
+		}
+		if down > cycle-1 {
+			down = cycle - 1
+		}
+
+		features := []Feature{ErrorReadsFeature{}}
+		if state.Stage == StageWriteErrors {
+			features = append(features, ErrorWritesFeature{})
+		}
+		return FaultSpec{
+			UpInterval:   time.Duration(cycle-down) * time.Second,
+			DownInterval: time.Duration(down) * time.Second,
+			Features:     features,
+		}
+	default:
+		return FaultSpec{DownInterval: cfg.Tick}
+	}
+}
+
+// steps returns the generator of schedule steps.
+func (cfg DegradationConfig) steps() func(int) (ScheduleStep, bool) {
+	next := cfg.states()
+
+	return func(i int) (ScheduleStep, bool) {
+		state, ok := next(i)
+		if !ok {
+			return ScheduleStep{}, false
+		}
+
+		step := ScheduleStep{Offset: time.Duration(i) * cfg.Tick, Spec: cfg.spec(state)}
+		cfg.Logf("dmflakey: degradation (%s, seed %d) step %d at %v: %s %.2f: %s",
+			cfg.Curve, cfg.Seed, i, step.Offset, state.Stage, state.Intensity, step.Spec)
+		return step, true
+	}
+}
+
+// DegradationSteps returns all the steps from healthy to offline. It's
+// useful to review the curve before running it.
+func DegradationSteps(cfg DegradationConfig) ([]ScheduleStep, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Logf = func(string, ...any) {}
+
+	var (
+		steps []ScheduleStep
+		next  = cfg.steps()
+	)
+	for i := 0; ; i++ {
+		step, ok := next(i)
+		if !ok {
+			return steps, nil
+		}
+		steps = append(steps, step)
+	}
+}
+
+// StartDegradation ramps the fault rate of flakey device over time, from
+// occasional random read corruption, to read errors, to write errors and
+// finally to offline. The schedule stops after the device goes offline, one
+// reload fails or the context is canceled.
+//
+// Only WithSyncFSFeatOpt takes effect. The context is also used to abort the
+// in-flight transition.
+//
+// The read-corrupt and read-errors stages use random_read_corrupt and
+// error_reads, which require Linux 6.6+ and flakey target 1.5.0+. The support
+// is checked up front and the error wraps ErrUnsupportedByKernel on older
+// kernels.
+func StartDegradation(ctx context.Context, f Flakey, cfg DegradationConfig, opts ...FeatOpt) (*Schedule, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: Every curve starts from read-corrupt stage unless it goes
+	// offline directly.
+	if first, _ := cfg.steps()(0); len(first.Spec.Features) > 0 {
+		for _, feat := range []Feature{RandomReadCorruptFeature{}, ErrorReadsFeature{}} {
+			if err := checkFeatureSupport(feat.Name()); err != nil {
+				return nil, fmt.Errorf("failed to start degradation: %w", err)
+			}
+		}
+	}
+
+	s := newSchedule()
+	go s.run(ctx, f, cfg.steps(), opts...)
+	return s, nil
+}
@@ -0,0 +1,140 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stageOf returns the degradation stage of spec generated by model.
+func stageOf(spec FaultSpec) DegradationStage {
+	switch {
+	case len(spec.Features) == 0:
+		return StageOffline
+	case len(spec.Features) == 2:
+		return StageWriteErrors
+	case spec.Features[0].Name() == (ErrorReadsFeature{}).Name():
+		return StageReadErrors
+	default:
+		return StageReadCorrupt
+	}
+}
+
+func TestDegradationSteps(t *testing.T) {
+	cfg := DegradationConfig{
+		Duration: 120 * time.Second,
+		Tick:     10 * time.Second,
+		Cycle:    10 * time.Second,
+	}
+
+	linear, err := DegradationSteps(cfg)
+	require.NoError(t, err)
+	require.Len(t, linear, 13)
+
+	assert.Equal(t, FaultSpec{
+		DownInterval: 10 * time.Second,
+		Features:     []Feature{RandomReadCorruptFeature{Probability: 1}},
+	}, linear[0].Spec)
+	assert.Equal(t, FaultSpec{
+		UpInterval:   9 * time.Second,
+		DownInterval: time.Second,
+		Features:     []Feature{ErrorReadsFeature{}},
+	}, linear[4].Spec)
+	assert.Equal(t, FaultSpec{DownInterval: 10 * time.Second}, linear[12].Spec)
+
+	cfg.Curve = CurveExponential
+	exponential, err := DegradationSteps(cfg)
+	require.NoError(t, err)
+	require.Len(t, exponential, 13)
+
+	countStage := func(steps []ScheduleStep, stage DegradationStage) int {
+		n := 0
+		for _, step := range steps {
+			if stageOf(step.Spec) == stage {
+				n++
+			}
+		}
+		return n
+	}
+
+	// exponential curve stays healthy-ish longer than linear one
+	assert.Greater(t, countStage(exponential, StageReadCorrupt), countStage(linear, StageReadCorrupt))
+
+	for _, steps := range [][]ScheduleStep{linear, exponential} {
+		for i := 1; i < len(steps); i++ {
+			assert.Equal(t, time.Duration(i)*cfg.Tick, steps[i].Offset)
+			assert.GreaterOrEqual(t, stageOf(steps[i].Spec), stageOf(steps[i-1].Spec), "stage never goes back")
+
+			_, err := steps[i].Spec.args()
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, StageOffline, stageOf(steps[len(steps)-1].Spec))
+	}
+}
+
+func TestDegradationMarkov(t *testing.T) {
+	cfg := DegradationConfig{
+		Curve:                 CurveMarkov,
+		Seed:                  7,
+		TransitionProbability: 0.3,
+	}
+
+	steps, err := DegradationSteps(cfg)
+	require.NoError(t, err)
+	require.NotEmpty(t, steps)
+	assert.Equal(t, StageOffline, stageOf(steps[len(steps)-1].Spec))
+
+	replayed, err := DegradationSteps(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, steps, replayed)
+}
+
+func TestDegradationInvalidConfig(t *testing.T) {
+	for _, cfg := range []DegradationConfig{
+		{Curve: "cliff"},
+		{Cycle: time.Second},
+		{Tick: 5 * time.Second, Cycle: 10 * time.Second},
+		{TransitionProbability: 2},
+		{MaxCorruptProbability: MaxProbability + 1},
+	} {
+		_, err := DegradationSteps(cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestStartDegradation(t *testing.T) {
+	f := &recordFlakey{}
+
+	// zero ticks goes offline directly
+	s, err := StartDegradation(context.Background(), f, DegradationConfig{
+		Duration: time.Second,
+		Logf:     t.Logf,
+	})
+	require.NoError(t, err)
+
+	events, err := s.Wait()
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, []FaultSpec{{DownInterval: 10 * time.Second}}, f.specs())
+}
+
+func TestStartDegradationOnOldKernel(t *testing.T) {
+	defer useBackend(oldFlakeyBackend{})()
+
+	_, err := StartDegradation(context.Background(), &recordFlakey{}, DegradationConfig{Logf: t.Logf})
+	require.ErrorIs(t, err, ErrUnsupportedByKernel)
+}
+
+// oldFlakeyBackend reports the flakey target without random_read_corrupt.
+type oldFlakeyBackend struct {
+	dmBackend
+}
+
+func (oldFlakeyBackend) targetVersion(string) (version, error) {
+	return version{1, 4, 0}, nil
+}
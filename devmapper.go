@@ -0,0 +1,188 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuweid/go-dmflakey/dm"
+	"golang.org/x/sys/unix"
+)
+
+// dmBackend manages device-mapper devices.
+type dmBackend interface {
+	// create creates the device with table and activates it.
+	create(name, table string) error
+	// load loads the table into inactive slot.
+	load(name, table string) error
+	// suspend suspends the device. The filesystem is frozen if lockfs is
+	// true. It's aborted if the context is done.
+	suspend(ctx context.Context, name string, lockfs bool) error
+	// resume activates the inactive table if any and resumes the device.
+	resume(name string) error
+	// remove removes the device.
+	remove(name string) error
+	// status returns the device info and tables.
+	status(name string) (*Status, error)
+	// targetVersion returns the version of target registered in kernel.
+	targetVersion(target string) (version, error)
+}
+
+var (
+	backendOnce sync.Once
+	backend     dmBackend
+)
+
+// getBackend returns the ioctl backend if the DM_VERSION handshake on the
+// control device succeeds. Otherwise, it falls back to dmsetup, like the
+// kernel doesn't support the ioctl interface version required.
+func getBackend() dmBackend {
+	backendOnce.Do(func() {
+		backend = dmsetupBackend{}
+
+		if _, err := dm.Version(); err == nil {
+			backend = dmIoctlBackend{}
+		}
+	})
+	return backend
+}
+
+// newFlakeyDevice creates flakey device on the base device, which is the loop
+// device or the ebs device on it.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-flakey.html
+func newFlakeyDevice(flakeyDevice, baseDevice string, interval time.Duration) error {
+	baseSize, err := getBlkSize(baseDevice)
+	if err != nil {
+		return fmt.Errorf("failed to get device %s size: %w", baseDevice, err)
+	}
+
+	// The flakey device will be available in interval.Seconds().
+	table := dm.Table{{
+		Length: baseSize,
+		Target: dm.Flakey{Device: baseDevice, UpInterval: interval},
+	}}.String()
+
+	if err := getBackend().create(flakeyDevice, table); err != nil {
+		return fmt.Errorf("failed to create flakey device %s with table %s: %w",
+			flakeyDevice, table, err)
+	}
+	return nil
+}
+
+// newEBSDevice creates dm-ebs device on the loop device to emulate logical
+// block size smaller than physical one, like 512e drive. The loop device's
+// block size must be the physical block size.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-ebs.html
+func newEBSDevice(ebsDevice, loopDevice string, logical, physical int) error {
+	loopSize, err := getBlkSize(loopDevice)
+	if err != nil {
+		return fmt.Errorf("failed to get loop device %s size: %w", loopDevice, err)
+	}
+
+	table := dm.Table{{
+		Length: loopSize,
+		Target: dm.EBS{
+			Device:            loopDevice,
+			EmulatedSectors:   logical / SectorSize,
+			UnderlyingSectors: physical / SectorSize,
+		},
+	}}.String()
+
+	if err := getBackend().create(ebsDevice, table); err != nil {
+		return fmt.Errorf("failed to create ebs device %s with table %s, which requires dm-ebs (Linux 5.8+): %w",
+			ebsDevice, table, err)
+	}
+	return nil
+}
+
+// reloadFlakeyDevice reloads the flakey device with feature table.
+//
+// The table can have multiple lines, one line per target.
+//
+// The context only bounds suspend, which can block for a long time when
+// writeback is stuck on faulty device. The load and resume always run to the
+// end so that the device is never left suspended by reload.
+func reloadFlakeyDevice(ctx context.Context, flakeyDevice string, syncFS bool, table string) (retErr error) {
+	defer func() {
+		if err := resumeFlakeyDevice(flakeyDevice); err != nil {
+			retErr = errors.Join(retErr, &ReloadError{Device: flakeyDevice, Stage: ReloadResume, Err: err})
+		}
+	}()
+
+	if err := suspendFlakeyDevice(ctx, flakeyDevice, syncFS); err != nil {
+		return &ReloadError{Device: flakeyDevice, Stage: ReloadSuspend, Err: err}
+	}
+
+	if err := getBackend().load(flakeyDevice, table); err != nil {
+		return &ReloadError{
+			Device: flakeyDevice,
+			Stage:  ReloadLoad,
+			Err:    fmt.Errorf("%w with table (%s)", err, table),
+		}
+	}
+	return nil
+}
+
+// suspendFlakeyDevice suspends the flakey device. New bios are queued until
+// resume. The filesystem isn't frozen unless syncFS is true.
+//
+// The returned error wraps ErrSuspendTimeout if the context is done. The
+// context doesn't bound syncing filesystem if syncFS is true.
+func suspendFlakeyDevice(ctx context.Context, flakeyDevice string, syncFS bool) error {
+	// NOTE: The suspend on idle device succeeds even if it's signalled.
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w: %w", ErrSuspendTimeout, ctxErr)
+	}
+
+	err := getBackend().suspend(ctx, flakeyDevice, syncFS)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("%w: %w: %v", ErrSuspendTimeout, ctxErr, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// resumeFlakeyDevice resumes the flakey device. It's no-op if the device
+// isn't suspended.
+func resumeFlakeyDevice(flakeyDevice string) error {
+	return getBackend().resume(flakeyDevice)
+}
+
+// deleteFlakeyDevice removes flakey device or ebs device under it.
+func deleteFlakeyDevice(flakeyDevice string) error {
+	if err := getBackend().remove(flakeyDevice); err != nil {
+		return fmt.Errorf("failed to remove device %s: %w", flakeyDevice, err)
+	}
+	return nil
+}
+
+// isDeviceNotExist returns true if the error is caused by missing device.
+func isDeviceNotExist(err error) bool {
+	return errors.Is(err, unix.ENXIO) ||
+		strings.Contains(err.Error(), "No such device or address") ||
+		strings.Contains(err.Error(), "Device does not exist")
+}
+
+// getDeviceStatus returns the device info and tables from kernel.
+func getDeviceStatus(name string) (*Status, error) {
+	status, err := getBackend().status(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device %s status: %w", name, err)
+	}
+	return status, nil
+}
+
+// getFlakeyTargetVersion returns the version of dm-flakey target registered
+// in kernel.
+func getFlakeyTargetVersion() (version, error) {
+	return getBackend().targetVersion("flakey")
+}
@@ -0,0 +1,358 @@
+//go:build linux
+
+// Package dm manages device-mapper devices by ioctl on the control device,
+// without dmsetup.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/index.html
+package dm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// DeviceDir is the directory of device-mapper device nodes.
+const DeviceDir = "/dev/mapper"
+
+// DevicePath returns the node path of device.
+func DevicePath(name string) string {
+	return filepath.Join(DeviceDir, name)
+}
+
+// DeviceInfo is the state of device.
+type DeviceInfo struct {
+	// Name is the device name.
+	Name string
+	// UUID is the device UUID. It's empty if not set.
+	UUID string
+	// Suspended is true if the device is suspended.
+	Suspended bool
+	// ReadOnly is true if the device is read-only.
+	ReadOnly bool
+	// LiveTable is true if the device has live table.
+	LiveTable bool
+	// InactiveTable is true if there is loaded but not activated table.
+	InactiveTable bool
+	// OpenCount is the number of opener.
+	OpenCount int
+	// EventNumber is the event counter of device.
+	EventNumber uint32
+	// Major and Minor are the device number.
+	Major, Minor uint32
+	// TargetCount is the number of entries in live table.
+	TargetCount int
+}
+
+// Device is the device returned by List.
+type Device struct {
+	Name         string
+	Major, Minor uint32
+}
+
+// TargetVersion is the version of target registered in kernel.
+type TargetVersion struct {
+	Name    string
+	Version [3]uint32
+}
+
+// Create creates the device with table and activates it. The device node is
+// created if udev doesn't create it, like in container without udev. There is
+// no udev cookie in request, so nothing waits for udev.
+func Create(name string, table Table) (retErr error) {
+	if err := table.Validate(); err != nil {
+		return err
+	}
+
+	req, err := newDMRequest(name, 0)
+	if err != nil {
+		return err
+	}
+	if err := dmIoctlCall(dmDevCreateCmd, req); err != nil {
+		return err
+	}
+	dev := req.header().Dev
+
+	defer func() {
+		if retErr != nil {
+			if err := Remove(name); err != nil {
+				retErr = errors.Join(retErr, err)
+			}
+		}
+	}()
+
+	if err := Load(name, table); err != nil {
+		return err
+	}
+	if err := Resume(name); err != nil {
+		return err
+	}
+	return ensureDeviceNode(name, dev)
+}
+
+// Load loads the table into inactive slot. It's activated by Resume.
+func Load(name string, table Table) error {
+	if err := table.Validate(); err != nil {
+		return err
+	}
+
+	specs, err := encodeTable(table)
+	if err != nil {
+		return err
+	}
+
+	req, err := newDMRequest(name, len(specs))
+	if err != nil {
+		return err
+	}
+	copy(req.data(), specs)
+	req.header().TargetCount = uint32(len(table))
+
+	return dmIoctlCall(dmTableLoadCmd, req)
+}
+
+type suspendCfg struct {
+	flags uint32
+}
+
+// SuspendOpt is used to configure suspend.
+type SuspendOpt func(*suspendCfg)
+
+// WithNoLockFSSuspendOpt doesn't freeze the filesystem on device before
+// suspend.
+func WithNoLockFSSuspendOpt() SuspendOpt {
+	return func(cfg *suspendCfg) {
+		cfg.flags |= dmSkipLockfsFlag
+	}
+}
+
+// WithNoFlushSuspendOpt doesn't wait for in-flight I/O. It's only supported
+// by some targets, like multipath.
+func WithNoFlushSuspendOpt() SuspendOpt {
+	return func(cfg *suspendCfg) {
+		cfg.flags |= dmNoflushFlag
+	}
+}
+
+// Suspend suspends the device. New I/O is queued until Resume.
+//
+// The suspend waits for in-flight I/O in interruptible state, so it's aborted
+// with EINTR if the context is done. But the filesystem is frozen in
+// uninterruptible state unless WithNoLockFSSuspendOpt, which the context
+// can't bound.
+func Suspend(ctx context.Context, name string, opts ...SuspendOpt) error {
+	cfg := suspendCfg{flags: dmSuspendFlag}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	req, err := newDMRequest(name, 0)
+	if err != nil {
+		return err
+	}
+	req.header().Flags = cfg.flags
+
+	return runInterruptible(ctx, func() error {
+		return dmIoctlCall(dmDevSuspendCmd, req)
+	})
+}
+
+// Resume activates the inactive table if any and resumes the device.
+func Resume(name string) error {
+	req, err := newDMRequest(name, 0)
+	if err != nil {
+		return err
+	}
+	return dmIoctlCall(dmDevSuspendCmd, req)
+}
+
+// Remove removes the device and the node created by Create.
+func Remove(name string) error {
+	req, err := newDMRequest(name, 0)
+	if err != nil {
+		return err
+	}
+	if err := dmIoctlCall(dmDevRemoveCmd, req); err != nil {
+		return err
+	}
+
+	// NOTE: udev creates symlink instead of device node.
+	node := DevicePath(name)
+	if fi, err := os.Lstat(node); err == nil && fi.Mode()&os.ModeDevice != 0 {
+		if err := os.Remove(node); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove device node %s: %w", node, err)
+		}
+	}
+	return nil
+}
+
+// Info returns the state of device.
+func Info(name string) (*DeviceInfo, error) {
+	req, err := newDMRequest(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := dmIoctlCall(dmDevStatusCmd, req); err != nil {
+		return nil, err
+	}
+
+	hdr := req.header()
+	return &DeviceInfo{
+		Name:          cString(hdr.Name[:]),
+		UUID:          cString(hdr.UUID[:]),
+		Suspended:     hdr.Flags&dmSuspendFlag != 0,
+		ReadOnly:      hdr.Flags&dmReadonlyFlag != 0,
+		LiveTable:     hdr.Flags&dmActivePresentFlag != 0,
+		InactiveTable: hdr.Flags&dmInactivePresentFlag != 0,
+		OpenCount:     int(hdr.OpenCount),
+		EventNumber:   hdr.EventNr,
+		Major:         unix.Major(hdr.Dev),
+		Minor:         unix.Minor(hdr.Dev),
+		TargetCount:   int(hdr.TargetCount),
+	}, nil
+}
+
+// GetTable returns the live or inactive table of device. The targets are
+// Raw.
+func GetTable(name string, inactive bool) (Table, error) {
+	flags := uint32(dmStatusTableFlag)
+	if inactive {
+		flags |= dmQueryInactiveTableFlag
+	}
+
+	req, err := dmIoctlCallWithOutput(dmTableStatusCmd, name, flags, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := decodeTable(req.output(), int(req.header().TargetCount))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode table of %s: %w", name, err)
+	}
+	return table, nil
+}
+
+// List returns all the devices.
+func List() ([]Device, error) {
+	req, err := dmIoctlCallWithOutput(dmListDevicesCmd, "", 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: The name follows dev and next without padding.
+	const nameOffset = 12
+
+	var (
+		data    = req.output()
+		devices []Device
+	)
+	for off := 0; off+nameOffset <= len(data); {
+		nl := (*dmNameList)(unsafe.Pointer(&data[off]))
+		// NOTE: zero dev means there is no device.
+		if nl.Dev == 0 {
+			break
+		}
+
+		devices = append(devices, Device{
+			Name:  cString(data[off+nameOffset:]),
+			Major: unix.Major(nl.Dev),
+			Minor: unix.Minor(nl.Dev),
+		})
+
+		if nl.Next == 0 {
+			break
+		}
+		off += int(nl.Next)
+	}
+	return devices, nil
+}
+
+// Version returns the ioctl interface version of kernel. It fails if the
+// control device isn't available or the kernel doesn't support the interface
+// version required.
+func Version() ([3]uint32, error) {
+	req, err := newDMRequest("", 0)
+	if err != nil {
+		return [3]uint32{}, err
+	}
+	if err := dmIoctlCall(dmVersionCmd, req); err != nil {
+		return [3]uint32{}, err
+	}
+	return req.header().Version, nil
+}
+
+// Versions returns the targets registered in kernel.
+func Versions() ([]TargetVersion, error) {
+	req, err := dmIoctlCallWithOutput(dmListVersionsCmd, "", 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		data     = req.output()
+		hdrSize  = int(unsafe.Sizeof(dmTargetVersions{}))
+		versions []TargetVersion
+	)
+	for off := 0; off+hdrSize <= len(data); {
+		vers := (*dmTargetVersions)(unsafe.Pointer(&data[off]))
+		versions = append(versions, TargetVersion{
+			Name:    cString(data[off+hdrSize:]),
+			Version: vers.Version,
+		})
+
+		if vers.Next == 0 {
+			break
+		}
+		off += int(vers.Next)
+	}
+	return versions, nil
+}
+
+// Message sends the message to the target at sector and returns the output
+// of target if any, like "addbadblock 10" to dust target.
+func Message(name string, sector int64, msg string) (string, error) {
+	input := make([]byte, dmTargetMsgSize+len(msg)+1)
+	*(*uint64)(unsafe.Pointer(&input[0])) = uint64(sector)
+	copy(input[dmTargetMsgSize:], msg)
+
+	req, err := dmIoctlCallWithOutput(dmTargetMsgCmd, name, 0, input)
+	if err != nil {
+		return "", err
+	}
+
+	if req.header().Flags&dmDataOutFlag == 0 {
+		return "", nil
+	}
+	return cString(req.output()), nil
+}
+
+// ensureDeviceNode creates the device node if udev doesn't create it. The
+// node with different device number or dangling symlink is replaced, since it
+// might be left by the device removed without udev.
+func ensureDeviceNode(name string, dev uint64) error {
+	node := DevicePath(name)
+
+	var st unix.Stat_t
+	if err := unix.Stat(node, &st); err == nil && st.Mode&unix.S_IFMT == unix.S_IFBLK &&
+		unix.Major(st.Rdev) == unix.Major(dev) && unix.Minor(st.Rdev) == unix.Minor(dev) {
+		return nil
+	}
+
+	if err := os.MkdirAll(DeviceDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", DeviceDir, err)
+	}
+	if err := os.Remove(node); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale node %s: %w", node, err)
+	}
+
+	mkdev := unix.Mkdev(unix.Major(dev), unix.Minor(dev))
+	if err := unix.Mknod(node, unix.S_IFBLK|0600, int(mkdev)); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to create device node %s: %w", node, err)
+	}
+	return nil
+}
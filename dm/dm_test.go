@@ -0,0 +1,139 @@
+//go:build linux
+
+package dm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getuid() != 0 {
+		fmt.Fprintln(os.Stderr, "This test must be run as root.")
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestVersion(t *testing.T) {
+	ver, err := Version()
+	require.NoError(t, err)
+	assert.Equal(t, dmIoctlVersion[0], ver[0])
+}
+
+func TestLifecycle(t *testing.T) {
+	const name = "go-dmflakey-dm"
+
+	table := Table{
+		{Start: 0, Length: 1024, Target: Zero{}},
+		{Start: 1024, Length: 1024, Target: Error{}},
+	}
+	require.NoError(t, Create(name, table))
+	defer Remove(name)
+
+	_, err := os.Stat(DevicePath(name))
+	require.NoError(t, err)
+
+	info, err := Info(name)
+	require.NoError(t, err)
+	assert.Equal(t, name, info.Name)
+	assert.True(t, info.LiveTable)
+	assert.False(t, info.Suspended)
+	assert.Equal(t, 2, info.TargetCount)
+
+	devices, err := List()
+	require.NoError(t, err)
+	assert.Contains(t, devices, Device{Name: name, Major: info.Major, Minor: info.Minor})
+
+	live, err := GetTable(name, false)
+	require.NoError(t, err)
+	assert.Equal(t, table.String(), live.String())
+
+	// load and activate new table
+	require.NoError(t, Suspend(context.Background(), name, WithNoLockFSSuspendOpt()))
+	require.NoError(t, Load(name, Table{{Length: 2048, Target: Zero{}}}))
+
+	info, err = Info(name)
+	require.NoError(t, err)
+	assert.True(t, info.Suspended)
+	assert.True(t, info.InactiveTable)
+
+	inactive, err := GetTable(name, true)
+	require.NoError(t, err)
+	assert.Equal(t, "0 2048 zero", inactive.String())
+
+	require.NoError(t, Resume(name))
+
+	live, err = GetTable(name, false)
+	require.NoError(t, err)
+	assert.Equal(t, "0 2048 zero", live.String())
+
+	versions, err := Versions()
+	require.NoError(t, err)
+	assert.Contains(t, versionNames(versions), "zero")
+
+	require.NoError(t, Remove(name))
+
+	_, err = Info(name)
+	assert.True(t, errors.Is(err, unix.ENXIO))
+
+	_, err = os.Stat(DevicePath(name))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestCreateWithStaleNode(t *testing.T) {
+	const name = "go-dmflakey-dm-stale"
+
+	// stale node left by device removed without udev
+	require.NoError(t, os.MkdirAll(DeviceDir, 0755))
+	require.NoError(t, unix.Mknod(DevicePath(name), unix.S_IFBLK|0600, int(unix.Mkdev(7, 1024))))
+	defer os.Remove(DevicePath(name))
+
+	require.NoError(t, Create(name, Table{{Length: 1024, Target: Zero{}}}))
+	defer Remove(name)
+
+	info, err := Info(name)
+	require.NoError(t, err)
+
+	var st unix.Stat_t
+	require.NoError(t, unix.Stat(DevicePath(name), &st))
+	assert.Equal(t, info.Major, unix.Major(st.Rdev))
+	assert.Equal(t, info.Minor, unix.Minor(st.Rdev))
+}
+
+func TestMessage(t *testing.T) {
+	const name = "go-dmflakey-dm-dust"
+
+	// dust needs underlying device
+	require.NoError(t, Create(name+"-base", Table{{Length: 1024, Target: Zero{}}}))
+	defer Remove(name + "-base")
+
+	err := Create(name, Table{{Length: 1024, Target: Dust{Device: DevicePath(name + "-base"), BlockSize: 512}}})
+	if err != nil {
+		t.Skipf("skip: dust target is not available: %v", err)
+	}
+	defer Remove(name)
+
+	_, err = Message(name, 0, "addbadblock 10")
+	require.NoError(t, err)
+
+	out, err := Message(name, 0, "queryblock 10")
+	require.NoError(t, err)
+	assert.Contains(t, out, "found")
+	assert.NotContains(t, out, "not found")
+}
+
+func versionNames(versions []TargetVersion) []string {
+	var names []string
+	for _, v := range versions {
+		names = append(names, v.Name)
+	}
+	return names
+}
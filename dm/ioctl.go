@@ -0,0 +1,321 @@
+//go:build linux
+
+package dm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ControlDevice is the device-mapper control device.
+const ControlDevice = "/dev/mapper/control"
+
+// device-mapper ioctl commands.
+//
+// REF: https://github.com/torvalds/linux/blob/master/include/uapi/linux/dm-ioctl.h
+const (
+	dmVersionCmd      = 0
+	dmListDevicesCmd  = 2
+	dmDevCreateCmd    = 3
+	dmDevRemoveCmd    = 4
+	dmDevSuspendCmd   = 6
+	dmDevStatusCmd    = 7
+	dmTableLoadCmd    = 9
+	dmTableStatusCmd  = 12
+	dmListVersionsCmd = 13
+	dmTargetMsgCmd    = 14
+)
+
+var dmCmdNames = map[uint]string{
+	dmVersionCmd:      "DM_VERSION",
+	dmListDevicesCmd:  "DM_LIST_DEVICES",
+	dmDevCreateCmd:    "DM_DEV_CREATE",
+	dmDevRemoveCmd:    "DM_DEV_REMOVE",
+	dmDevSuspendCmd:   "DM_DEV_SUSPEND",
+	dmDevStatusCmd:    "DM_DEV_STATUS",
+	dmTableLoadCmd:    "DM_TABLE_LOAD",
+	dmTableStatusCmd:  "DM_TABLE_STATUS",
+	dmListVersionsCmd: "DM_LIST_VERSIONS",
+	dmTargetMsgCmd:    "DM_TARGET_MSG",
+}
+
+// device-mapper ioctl flags.
+const (
+	dmReadonlyFlag           = 1 << 0
+	dmSuspendFlag            = 1 << 1
+	dmStatusTableFlag        = 1 << 4
+	dmActivePresentFlag      = 1 << 5
+	dmInactivePresentFlag    = 1 << 6
+	dmBufferFullFlag         = 1 << 8
+	dmSkipLockfsFlag         = 1 << 10
+	dmNoflushFlag            = 1 << 11
+	dmQueryInactiveTableFlag = 1 << 12
+	dmDataOutFlag            = 1 << 16
+)
+
+const (
+	// dmIoctlSize is sizeof(struct dm_ioctl).
+	dmIoctlSize = 312
+	// dmTargetSpecSize is sizeof(struct dm_target_spec).
+	dmTargetSpecSize = 40
+	// dmNameLen is DM_NAME_LEN including the trailing NUL.
+	dmNameLen = 128
+	// dmUUIDLen is DM_UUID_LEN including the trailing NUL.
+	dmUUIDLen = 129
+	// dmMaxTypeName is DM_MAX_TYPE_NAME including the trailing NUL.
+	dmMaxTypeName = 16
+	// dmDataSize is the initial data size for the output of kernel. It's
+	// doubled if the kernel reports buffer full.
+	dmDataSize = 16 << 10
+)
+
+// dmIoctlVersion is the minimum interface version required. The kernel
+// accepts any minor version older than itself.
+var dmIoctlVersion = [3]uint32{4, 0, 0}
+
+// dmIoctl is struct dm_ioctl.
+type dmIoctl struct {
+	Version     [3]uint32
+	DataSize    uint32
+	DataStart   uint32
+	TargetCount uint32
+	OpenCount   int32
+	Flags       uint32
+	EventNr     uint32
+	_           uint32
+	Dev         uint64
+	Name        [dmNameLen]byte
+	UUID        [dmUUIDLen]byte
+	_           [7]byte
+}
+
+// dmTargetSpec is struct dm_target_spec.
+type dmTargetSpec struct {
+	SectorStart uint64
+	Length      uint64
+	Status      int32
+	Next        uint32
+	TargetType  [dmMaxTypeName]byte
+}
+
+// dmTargetVersions is the header of struct dm_target_versions.
+type dmTargetVersions struct {
+	Next    uint32
+	Version [3]uint32
+}
+
+// dmNameList is the header of struct dm_name_list.
+type dmNameList struct {
+	Dev  uint64
+	Next uint32
+}
+
+// dmTargetMsgSize is the size of sector in struct dm_target_msg.
+const dmTargetMsgSize = 8
+
+// dmRequest is the buffer for dm ioctl, which is struct dm_ioctl followed by
+// data.
+type dmRequest struct {
+	buf []byte
+}
+
+// newDMRequest returns request with dataSize bytes data for device.
+func newDMRequest(name string, dataSize int) (*dmRequest, error) {
+	if len(name) >= dmNameLen {
+		return nil, fmt.Errorf("device name %q is longer than %d", name, dmNameLen-1)
+	}
+
+	// NOTE: Use []uint64 to make sure that the struct is 8 bytes aligned.
+	size := alignUp(dmIoctlSize+dataSize, 8)
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&make([]uint64, size/8)[0])), size)
+
+	req := &dmRequest{buf: buf}
+	hdr := req.header()
+	hdr.Version = dmIoctlVersion
+	hdr.DataSize = uint32(size)
+	hdr.DataStart = dmIoctlSize
+	copy(hdr.Name[:], name)
+	return req, nil
+}
+
+// header returns struct dm_ioctl.
+func (req *dmRequest) header() *dmIoctl {
+	return (*dmIoctl)(unsafe.Pointer(&req.buf[0]))
+}
+
+// data returns the input data after struct dm_ioctl.
+func (req *dmRequest) data() []byte {
+	return req.buf[dmIoctlSize:]
+}
+
+// output returns the data written by kernel.
+func (req *dmRequest) output() []byte {
+	hdr := req.header()
+	if int(hdr.DataStart) >= len(req.buf) {
+		return nil
+	}
+
+	end := len(req.buf)
+	if hdr.DataSize > hdr.DataStart && int(hdr.DataSize) < end {
+		end = int(hdr.DataSize)
+	}
+	return req.buf[hdr.DataStart:end]
+}
+
+// dmIoctlCallWithOutput calls the ioctl and grows the buffer until the output
+// fits in. The input is copied into data of each request.
+func dmIoctlCallWithOutput(cmd uint, name string, flags uint32, input []byte) (*dmRequest, error) {
+	for size := dmDataSize; ; size *= 2 {
+		req, err := newDMRequest(name, len(input)+size)
+		if err != nil {
+			return nil, err
+		}
+		req.header().Flags = flags
+		copy(req.data(), input)
+
+		if err := dmIoctlCall(cmd, req); err != nil {
+			return nil, err
+		}
+		if req.header().Flags&dmBufferFullFlag == 0 {
+			return req, nil
+		}
+	}
+}
+
+// dmIoctlCall calls the ioctl cmd on control device.
+func dmIoctlCall(cmd uint, req *dmRequest) error {
+	control, err := os.OpenFile(ControlDevice, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", ControlDevice, err)
+	}
+	defer control.Close()
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, control.Fd(), dmIoctlNumber(cmd), uintptr(unsafe.Pointer(&req.buf[0]))); errno != 0 {
+		return fmt.Errorf("%s on %q: %w", dmCmdNames[cmd], cString(req.header().Name[:]), errno)
+	}
+	runtime.KeepAlive(req)
+	return nil
+}
+
+// dmIoctlNumber returns _IOWR(DM_IOCTL, cmd, struct dm_ioctl).
+func dmIoctlNumber(cmd uint) uintptr {
+	return uintptr(3<<30 | dmIoctlSize<<16 | 0xfd<<8 | cmd)
+}
+
+// runInterruptible runs fn on locked OS thread. If the context is done, the
+// thread is signalled by SIGURG until fn returns, so that the interruptible
+// wait in kernel returns EINTR. The Go runtime handles SIGURG as preemption
+// request, so it's harmless.
+func runInterruptible(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	var (
+		tidCh = make(chan int, 1)
+		// NOTE: errCh is unbuffered so that the thread stays locked
+		// until the result is received.
+		errCh = make(chan error)
+	)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		tidCh <- unix.Gettid()
+		errCh <- fn()
+	}()
+	tid := <-tidCh
+
+	var (
+		done = ctx.Done()
+		tick <-chan time.Time
+	)
+	for {
+		select {
+		case err := <-errCh:
+			return err
+		case <-done:
+			done = nil
+
+			ticker := time.NewTicker(10 * time.Millisecond)
+			defer ticker.Stop()
+			tick = ticker.C
+
+			_ = unix.Tgkill(unix.Getpid(), tid, unix.SIGURG)
+		case <-tick:
+			_ = unix.Tgkill(unix.Getpid(), tid, unix.SIGURG)
+		}
+	}
+}
+
+// encodeTable encodes the table into target specs, each followed by
+// parameters string and aligned to 8 bytes.
+func encodeTable(table Table) ([]byte, error) {
+	var buf []byte
+
+	for _, e := range table {
+		typ, params := e.Target.Type(), e.Target.Params()
+		if len(typ) >= dmMaxTypeName {
+			return nil, fmt.Errorf("invalid target type %q", typ)
+		}
+
+		size := alignUp(dmTargetSpecSize+len(params)+1, 8)
+
+		spec := dmTargetSpec{SectorStart: uint64(e.Start), Length: uint64(e.Length), Next: uint32(size)}
+		copy(spec.TargetType[:], typ)
+
+		rec := make([]byte, size)
+		copy(rec, unsafe.Slice((*byte)(unsafe.Pointer(&spec)), dmTargetSpecSize))
+		copy(rec[dmTargetSpecSize:], params)
+		buf = append(buf, rec...)
+	}
+	return buf, nil
+}
+
+// decodeTable decodes count target specs from the output of table status.
+//
+// NOTE: The next is the offset from the first target spec in output, which
+// is different from input.
+func decodeTable(data []byte, count int) (Table, error) {
+	var (
+		table Table
+		off   int
+	)
+	for i := 0; i < count; i++ {
+		if off+dmTargetSpecSize > len(data) {
+			return nil, fmt.Errorf("invalid target spec offset %d", off)
+		}
+
+		spec := (*dmTargetSpec)(unsafe.Pointer(&data[off]))
+		table = append(table, Entry{
+			Start:  int64(spec.SectorStart),
+			Length: int64(spec.Length),
+			Target: Raw{
+				TargetType: cString(spec.TargetType[:]),
+				Args:       cString(data[off+dmTargetSpecSize:]),
+			},
+		})
+		off = int(spec.Next)
+	}
+	return table, nil
+}
+
+// cString returns the string before the first NUL.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// alignUp rounds n up to multiple of align.
+func alignUp(n, align int) int {
+	return (n + align - 1) / align * align
+}
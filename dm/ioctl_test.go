@@ -0,0 +1,89 @@
+//go:build linux
+
+package dm
+
+import (
+	"context"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDMIoctlLayout(t *testing.T) {
+	assert.Equal(t, uintptr(dmIoctlSize), unsafe.Sizeof(dmIoctl{}))
+	assert.Equal(t, uintptr(dmTargetSpecSize), unsafe.Sizeof(dmTargetSpec{}))
+	assert.Equal(t, uintptr(48), unsafe.Offsetof(dmIoctl{}.Name))
+
+	// DM_VERSION and DM_TABLE_LOAD
+	assert.Equal(t, uintptr(0xc138fd00), dmIoctlNumber(0))
+	assert.Equal(t, uintptr(0xc138fd09), dmIoctlNumber(dmTableLoadCmd))
+}
+
+func TestEncodeTable(t *testing.T) {
+	table := Table{
+		{Start: 0, Length: 100, Target: Linear{Device: "7:0"}},
+		{Start: 100, Length: 50, Target: Flakey{Device: "7:0", Offset: 100, DownInterval: time.Minute, Features: []string{"drop_writes"}}},
+		{Start: 150, Length: 50, Target: Error{}},
+	}
+
+	buf, err := encodeTable(table)
+	require.NoError(t, err)
+
+	var off int
+	for _, e := range table {
+		spec := (*dmTargetSpec)(unsafe.Pointer(&buf[off]))
+		assert.Equal(t, uint64(e.Start), spec.SectorStart)
+		assert.Equal(t, uint64(e.Length), spec.Length)
+		assert.Equal(t, e.Target.Type(), cString(spec.TargetType[:]))
+		assert.Equal(t, e.Target.Params(), cString(buf[off+dmTargetSpecSize:]))
+		assert.Zero(t, spec.Next%8, "aligned to 8 bytes")
+
+		off += int(spec.Next)
+	}
+	assert.Equal(t, len(buf), off)
+
+	// the output uses offset from the first spec
+	var prev uint32
+	for i := 0; i < len(table); i++ {
+		spec := (*dmTargetSpec)(unsafe.Pointer(&buf[prev]))
+		spec.Next += prev
+		prev = spec.Next
+	}
+
+	decoded, err := decodeTable(buf, len(table))
+	require.NoError(t, err)
+	assert.Equal(t, table.String(), decoded.String())
+
+	_, err = encodeTable(Table{{Length: 1, Target: Raw{TargetType: "averyveryverylongtarget"}}})
+	assert.Error(t, err)
+}
+
+func TestNewDMRequest(t *testing.T) {
+	req, err := newDMRequest("go-dmflakey", 10)
+	require.NoError(t, err)
+
+	hdr := req.header()
+	assert.Equal(t, dmIoctlVersion, hdr.Version)
+	assert.Equal(t, uint32(dmIoctlSize), hdr.DataStart)
+	assert.Equal(t, uint32(328), hdr.DataSize)
+	assert.Equal(t, "go-dmflakey", cString(hdr.Name[:]))
+	assert.Zero(t, uintptr(unsafe.Pointer(hdr))%8)
+
+	_, err = newDMRequest(string(make([]byte, dmNameLen)), 0)
+	assert.Error(t, err)
+}
+
+func TestRunInterruptible(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// nanosleep(2) returns EINTR once the thread is signalled.
+	err := runInterruptible(ctx, func() error {
+		return unix.Nanosleep(&unix.Timespec{Sec: 10}, nil)
+	})
+	assert.ErrorIs(t, err, unix.EINTR)
+}
@@ -0,0 +1,319 @@
+//go:build linux
+
+package dm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SectorSize is the size of sector used by device-mapper table.
+const SectorSize = 512
+
+// Target is the mapping type of one table entry.
+type Target interface {
+	// Type returns the target type name, like linear or flakey.
+	Type() string
+	// Params returns the target parameters in table.
+	Params() string
+}
+
+// Entry is one line of table, which maps [Start, Start+Length) sectors of
+// the device to the target.
+type Entry struct {
+	// Start is the first sector of the entry.
+	Start int64
+	// Length is the number of sectors.
+	Length int64
+	// Target is the mapping.
+	Target Target
+}
+
+// String returns the entry in <start> <length> <type> <params> format.
+func (e Entry) String() string {
+	line := fmt.Sprintf("%d %d %s", e.Start, e.Length, e.Target.Type())
+	if params := e.Target.Params(); params != "" {
+		line += " " + params
+	}
+	return line
+}
+
+// Table is the device-mapper table.
+type Table []Entry
+
+// String returns the table, one line per entry.
+func (t Table) String() string {
+	lines := make([]string, 0, len(t))
+	for _, e := range t {
+		lines = append(lines, e.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate returns error if the table is empty, or the entries have holes,
+// overlaps or no target.
+func (t Table) Validate() error {
+	if len(t) == 0 {
+		return fmt.Errorf("table is empty")
+	}
+
+	var next int64
+	for _, e := range t {
+		if e.Target == nil {
+			return fmt.Errorf("entry at sector %d has no target", e.Start)
+		}
+		if e.Start != next || e.Length <= 0 {
+			return fmt.Errorf("entry %q must start at sector %d with positive length", e, next)
+		}
+		next = e.Start + e.Length
+	}
+	return nil
+}
+
+// ParseTable parses the table, one line per entry. The targets are Raw.
+func ParseTable(table string) (Table, error) {
+	var res Table
+
+	for _, line := range strings.Split(table, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid table line %q", line)
+		}
+
+		var (
+			e   = Entry{Target: Raw{TargetType: fields[2], Args: strings.Join(fields[3:], " ")}}
+			err error
+		)
+		if e.Start, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid start in table line %q: %w", line, err)
+		}
+		if e.Length, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid length in table line %q: %w", line, err)
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// Raw is any target with preformatted parameters.
+type Raw struct {
+	TargetType string
+	Args       string
+}
+
+// Type implements Target.
+func (t Raw) Type() string { return t.TargetType }
+
+// Params implements Target.
+func (t Raw) Params() string { return t.Args }
+
+// Linear maps the sectors onto the device linearly.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/linear.html
+type Linear struct {
+	// Device is the path or major:minor of underlying device.
+	Device string
+	// Offset is the start sector on the device.
+	Offset int64
+}
+
+// Type implements Target.
+func (Linear) Type() string { return "linear" }
+
+// Params implements Target.
+func (t Linear) Params() string {
+	return fmt.Sprintf("%s %d", t.Device, t.Offset)
+}
+
+// Flakey behaves like linear target in up interval and then misbehaves in
+// down interval. All the I/O fails in down interval if there is no feature.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-flakey.html
+type Flakey struct {
+	// Device is the path or major:minor of underlying device.
+	Device string
+	// Offset is the start sector on the device.
+	Offset int64
+	// UpInterval and DownInterval are rounded down to seconds.
+	UpInterval, DownInterval time.Duration
+	// Features are the feature arguments, like
+	// []string{"drop_writes", "corrupt_bio_byte", "32", "r", "1", "0"}.
+	// The element with spaces is split into arguments, so that the number of
+	// arguments in table is correct.
+	Features []string
+}
+
+// Type implements Target.
+func (Flakey) Type() string { return "flakey" }
+
+// Params implements Target.
+func (t Flakey) Params() string {
+	params := fmt.Sprintf("%s %d %d %d", t.Device, t.Offset,
+		int(t.UpInterval.Seconds()), int(t.DownInterval.Seconds()))
+	if args := strings.Fields(strings.Join(t.Features, " ")); len(args) > 0 {
+		params += fmt.Sprintf(" %d %s", len(args), strings.Join(args, " "))
+	}
+	return params
+}
+
+// Error fails all the I/O.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/index.html
+type Error struct{}
+
+// Type implements Target.
+func (Error) Type() string { return "error" }
+
+// Params implements Target.
+func (Error) Params() string { return "" }
+
+// Zero returns zeros on read and drops writes silently.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/zero.html
+type Zero struct{}
+
+// Type implements Target.
+func (Zero) Type() string { return "zero" }
+
+// Params implements Target.
+func (Zero) Params() string { return "" }
+
+// DelayPath is the device and delay of one I/O direction in delay target.
+type DelayPath struct {
+	// Device is the path or major:minor of underlying device.
+	Device string
+	// Offset is the start sector on the device.
+	Offset int64
+	// Delay is rounded down to milliseconds.
+	Delay time.Duration
+}
+
+// String returns <device> <offset> <delay>.
+func (p DelayPath) String() string {
+	return fmt.Sprintf("%s %d %d", p.Device, p.Offset, p.Delay.Milliseconds())
+}
+
+// Delay delays the I/O. Reads use Read path. Writes and flushes use Read
+// path unless Write and Flush are set. Flush requires Write.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/delay.html
+type Delay struct {
+	Read  DelayPath
+	Write *DelayPath
+	Flush *DelayPath
+}
+
+// Type implements Target.
+func (Delay) Type() string { return "delay" }
+
+// Params implements Target.
+func (t Delay) Params() string {
+	params := t.Read.String()
+	if t.Write != nil {
+		params += " " + t.Write.String()
+		if t.Flush != nil {
+			params += " " + t.Flush.String()
+		}
+	}
+	return params
+}
+
+// Dust fails reads on the bad blocks, which are added by messages like
+// "addbadblock <block>" and enabled by "enable".
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-dust.html
+type Dust struct {
+	// Device is the path or major:minor of underlying device.
+	Device string
+	// Offset is the start sector on the device.
+	Offset int64
+	// BlockSize is the size of block in bytes.
+	BlockSize int
+}
+
+// Type implements Target.
+func (Dust) Type() string { return "dust" }
+
+// Params implements Target.
+func (t Dust) Params() string {
+	return fmt.Sprintf("%s %d %d", t.Device, t.Offset, t.BlockSize)
+}
+
+// EBS emulates logical block size smaller than the one of underlying device,
+// like 512e drive on 4K native device. The write smaller than the underlying
+// block is done by read-modify-write.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-ebs.html
+type EBS struct {
+	// Device is the path or major:minor of underlying device.
+	Device string
+	// Offset is the start sector on the device.
+	Offset int64
+	// EmulatedSectors is the emulated logical block size in sectors.
+	EmulatedSectors int
+	// UnderlyingSectors is the block size of underlying device in sectors.
+	// Zero means the logical block size of underlying device.
+	UnderlyingSectors int
+}
+
+// Type implements Target.
+func (EBS) Type() string { return "ebs" }
+
+// Params implements Target.
+func (t EBS) Params() string {
+	params := fmt.Sprintf("%s %d %d", t.Device, t.Offset, t.EmulatedSectors)
+	if t.UnderlyingSectors != 0 {
+		params += fmt.Sprintf(" %d", t.UnderlyingSectors)
+	}
+	return params
+}
+
+// Snapshot keeps the writes in COW device and the origin is unchanged.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/snapshot.html
+type Snapshot struct {
+	// Origin is the path or major:minor of origin device.
+	Origin string
+	// COW is the path or major:minor of exception store.
+	COW string
+	// Persistent keeps the snapshot across reboot.
+	Persistent bool
+	// ChunkSize is the number of sectors of one chunk.
+	ChunkSize int64
+}
+
+// Type implements Target.
+func (Snapshot) Type() string { return "snapshot" }
+
+// Params implements Target.
+func (t Snapshot) Params() string {
+	mode := "N"
+	if t.Persistent {
+		mode = "P"
+	}
+	return fmt.Sprintf("%s %s %s %d", t.Origin, t.COW, mode, t.ChunkSize)
+}
+
+// LogWrites logs all the writes into log device, which can be replayed to
+// check crash consistency.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/log-writes.html
+type LogWrites struct {
+	// Device is the path or major:minor of underlying device.
+	Device string
+	// LogDevice is the path or major:minor of log device.
+	LogDevice string
+}
+
+// Type implements Target.
+func (LogWrites) Type() string { return "log-writes" }
+
+// Params implements Target.
+func (t LogWrites) Params() string {
+	return fmt.Sprintf("%s %s", t.Device, t.LogDevice)
+}
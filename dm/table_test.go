@@ -0,0 +1,79 @@
+//go:build linux
+
+package dm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetParams(t *testing.T) {
+	for _, tc := range []struct {
+		target   Target
+		expected string
+	}{
+		{Linear{Device: "/dev/loop0", Offset: 8}, "linear /dev/loop0 8"},
+		{Flakey{Device: "7:0", UpInterval: time.Minute}, "flakey 7:0 0 60 0"},
+		{
+			Flakey{Device: "7:0", Offset: 8, DownInterval: time.Minute, Features: []string{"corrupt_bio_byte", "32", "r", "1", "0"}},
+			"flakey 7:0 8 0 60 5 corrupt_bio_byte 32 r 1 0",
+		},
+		{
+			Flakey{Device: "7:0", DownInterval: time.Minute, Features: []string{"drop_writes", "corrupt_bio_byte 32 r 1 0"}},
+			"flakey 7:0 0 0 60 6 drop_writes corrupt_bio_byte 32 r 1 0",
+		},
+		{Error{}, "error"},
+		{Zero{}, "zero"},
+		{Delay{Read: DelayPath{Device: "7:0", Delay: 100 * time.Millisecond}}, "delay 7:0 0 100"},
+		{
+			Delay{
+				Read:  DelayPath{Device: "7:0"},
+				Write: &DelayPath{Device: "7:1", Offset: 8, Delay: time.Second},
+				Flush: &DelayPath{Device: "7:1", Offset: 8, Delay: 2 * time.Second},
+			},
+			"delay 7:0 0 0 7:1 8 1000 7:1 8 2000",
+		},
+		{Dust{Device: "7:0", BlockSize: 4096}, "dust 7:0 0 4096"},
+		{EBS{Device: "7:0", EmulatedSectors: 1}, "ebs 7:0 0 1"},
+		{EBS{Device: "7:0", EmulatedSectors: 1, UnderlyingSectors: 8}, "ebs 7:0 0 1 8"},
+		{Snapshot{Origin: "7:0", COW: "7:1", Persistent: true, ChunkSize: 16}, "snapshot 7:0 7:1 P 16"},
+		{LogWrites{Device: "7:0", LogDevice: "7:1"}, "log-writes 7:0 7:1"},
+		{Raw{TargetType: "crypt", Args: "aes-xts-plain64 - 0 7:0 0"}, "crypt aes-xts-plain64 - 0 7:0 0"},
+	} {
+		assert.Equal(t, "0 100 "+tc.expected, Entry{Length: 100, Target: tc.target}.String())
+	}
+}
+
+func TestTable(t *testing.T) {
+	table := Table{
+		{Start: 0, Length: 100, Target: Linear{Device: "7:0"}},
+		{Start: 100, Length: 100, Target: Error{}},
+	}
+	require.NoError(t, table.Validate())
+	assert.Equal(t, "0 100 linear 7:0 0\n100 100 error", table.String())
+
+	parsed, err := ParseTable(table.String() + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, Table{
+		{Start: 0, Length: 100, Target: Raw{TargetType: "linear", Args: "7:0 0"}},
+		{Start: 100, Length: 100, Target: Raw{TargetType: "error"}},
+	}, parsed)
+
+	for name, table := range map[string]Table{
+		"empty":     nil,
+		"no target": {{Length: 100}},
+		"hole":      {{Length: 100, Target: Zero{}}, {Start: 200, Length: 100, Target: Zero{}}},
+		"overlap":   {{Length: 100, Target: Zero{}}, {Start: 50, Length: 100, Target: Zero{}}},
+		"zero size": {{Target: Zero{}}},
+	} {
+		assert.Error(t, table.Validate(), name)
+	}
+
+	for _, s := range []string{"0 100", "x 100 zero", "0 x zero"} {
+		_, err := ParseTable(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -3,29 +3,74 @@
 package dmflakey
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/fuweid/go-dmflakey/dm"
+	"github.com/fuweid/go-dmflakey/loop"
 	"golang.org/x/sys/unix"
 )
 
 type featCfg struct {
+	// ctx is used to abort the transition.
+	ctx context.Context
 	// SyncFS attempts to synchronize filesystem before inject failure.
 	syncFS bool
 	// interval is used to determine how long the failure lasts.
 	interval time.Duration
+	// upInterval overrides the up interval if it's not nil.
+	upInterval *time.Duration
+	// downInterval overrides the down interval if it's not nil.
+	downInterval *time.Duration
+	// ranges limits the failure to the sector ranges.
+	ranges []SectorRange
+	// excludes are the sector ranges which are always healthy.
+	excludes []SectorRange
 }
 
-var defaultFeatCfg = featCfg{interval: defaultInterval}
+var defaultFeatCfg = featCfg{ctx: context.Background(), interval: defaultInterval}
 
 // FeatOpt is used to configure failure feature.
 type FeatOpt func(*featCfg)
 
+// spec returns FaultSpec with the features.
+//
+// By default, the interval is used as down interval if there is any feature
+// and the up interval is zero, and vice versa.
+func (cfg *featCfg) spec(features ...Feature) FaultSpec {
+	return cfg.faultSpec(len(features) > 0, features...)
+}
+
+// offlineSpec returns FaultSpec without any feature in down interval, which
+// fails all the I/O.
+func (cfg *featCfg) offlineSpec() FaultSpec {
+	return cfg.faultSpec(true)
+}
+
+// faultSpec returns FaultSpec using the interval as down interval if down is
+// true.
+func (cfg *featCfg) faultSpec(down bool, features ...Feature) FaultSpec {
+	spec := FaultSpec{UpInterval: cfg.interval, Features: features, Ranges: cfg.ranges, Excludes: cfg.excludes}
+	if down {
+		spec.UpInterval, spec.DownInterval = 0, cfg.interval
+	}
+
+	if cfg.upInterval != nil {
+		spec.UpInterval = *cfg.upInterval
+	}
+	if cfg.downInterval != nil {
+		spec.DownInterval = *cfg.downInterval
+	}
+	return spec
+}
+
 // WithIntervalFeatOpt updates the up time for the feature.
 func WithIntervalFeatOpt(interval time.Duration) FeatOpt {
 	return func(cfg *featCfg) {
@@ -33,15 +78,120 @@ func WithIntervalFeatOpt(interval time.Duration) FeatOpt {
 	}
 }
 
+// WithUpIntervalFeatOpt sets how long the device is available in each cycle.
+//
+// Combined with WithDownIntervalFeatOpt, the device works for up interval and
+// then misbehaves for down interval, over and over.
+func WithUpIntervalFeatOpt(up time.Duration) FeatOpt {
+	return func(cfg *featCfg) {
+		cfg.upInterval = &up
+	}
+}
+
+// WithDownIntervalFeatOpt sets how long the failure lasts in each cycle.
+//
+// If it's used with AllowWrites, all the read and write I/O is failed in
+// down interval because there is no feature.
+func WithDownIntervalFeatOpt(down time.Duration) FeatOpt {
+	return func(cfg *featCfg) {
+		cfg.downInterval = &down
+	}
+}
+
+// WithSectorRangesFeatOpt limits the failure to the sector ranges. The rest
+// of device is handled correctly.
+func WithSectorRangesFeatOpt(ranges ...SectorRange) FeatOpt {
+	return func(cfg *featCfg) {
+		cfg.ranges = append(cfg.ranges, ranges...)
+	}
+}
+
+// WithExcludedSectorRangesFeatOpt keeps the sector ranges healthy. It's
+// used to protect regions like filesystem metadata from the failure.
+func WithExcludedSectorRangesFeatOpt(ranges ...SectorRange) FeatOpt {
+	return func(cfg *featCfg) {
+		cfg.excludes = append(cfg.excludes, ranges...)
+	}
+}
+
+// WithContextFeatOpt sets the context to abort the transition, for instance,
+// when suspend is blocked by stuck writeback. The transition is rejected if
+// the context is already done.
+//
+// NOTE: The context doesn't bound freezing filesystem with
+// WithSyncFSFeatOpt(true), because the kernel syncs filesystem
+// uninterruptibly before suspend.
+func WithContextFeatOpt(ctx context.Context) FeatOpt {
+	return func(cfg *featCfg) {
+		cfg.ctx = ctx
+	}
+}
+
 // WithSyncFSFeatOpt is to determine if the caller wants to synchronize
-// filesystem before inject failure.
+// filesystem before inject failure. The sync can't be aborted by the context
+// of WithContextFeatOpt.
 func WithSyncFSFeatOpt(syncFS bool) FeatOpt {
 	return func(cfg *featCfg) {
 		cfg.syncFS = syncFS
 	}
 }
 
+// ErrTornDown is returned when the flakey device has been torn down.
+var ErrTornDown = errors.New("flakey device has been torn down")
+
+// ErrSuspendTimeout is returned when the context is done before the device is
+// suspended.
+var ErrSuspendTimeout = errors.New("suspend timed out")
+
+// ErrStalled is returned when the transition is requested while the device
+// is stalled.
+var ErrStalled = errors.New("flakey device is stalled")
+
+// ErrUnplugged is returned when the transition is requested while the device
+// is unplugged.
+var ErrUnplugged = errors.New("flakey device is unplugged")
+
+// ReloadStage is the stage of reloading flakey device.
+type ReloadStage string
+
+// Reload stages in order.
+const (
+	ReloadSuspend ReloadStage = "suspend"
+	ReloadLoad    ReloadStage = "load"
+	ReloadResume  ReloadStage = "resume"
+)
+
+// ReloadError records the failed stage of reload.
+type ReloadError struct {
+	Device string
+	Stage  ReloadStage
+	Err    error
+}
+
+// Error implements error interface.
+func (e *ReloadError) Error() string {
+	return fmt.Sprintf("failed to %s flakey device %s: %v", e.Stage, e.Device, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ReloadError) Unwrap() error {
+	return e.Err
+}
+
 // Flakey is to inject failure into device.
+//
+// It's safe for concurrent use. Transitions, including Teardown, are
+// serialized so that one reload (suspend, load and resume) never interleaves
+// with another one. Transitions after Teardown return ErrTornDown without
+// touching the device. Mode, History and Status don't wait for in-flight
+// transition.
+//
+// Transitions, Unstall and Teardown accept context by WithContextFeatOpt. If
+// the context is done while waiting for other transition or suspending
+// device, the transition is aborted and the device is resumed. The context
+// doesn't bound syncing filesystem with WithSyncFSFeatOpt(true). The error
+// wraps ErrSuspendTimeout if the suspend is aborted. Use errors.As with
+// ReloadError to tell which stage fails.
 type Flakey interface {
 	// DevicePath returns the flakey device path.
 	DevicePath() string
@@ -49,6 +199,32 @@ type Flakey interface {
 	// Filesystem returns filesystem's type.
 	Filesystem() FSType
 
+	// LoopAttachStats returns how the loop device was attached, like the
+	// number of attempts, to measure the contention of loop devices.
+	LoopAttachStats() loop.AttachStats
+
+	// LogicalBlockSize returns the logical block size in bytes. It's the
+	// smallest unit of I/O, like the alignment of O_DIRECT.
+	LogicalBlockSize() int
+
+	// PhysicalBlockSize returns the physical block size in bytes. It's the
+	// smallest unit that the device writes atomically.
+	PhysicalBlockSize() int
+
+	// Mode returns the spec loaded by the last successful transition.
+	Mode() FaultSpec
+
+	// History returns the latest 1024 transitions, including stall, unplug
+	// and failed ones, in order.
+	History() []Transition
+
+	// Status returns what the kernel is actually running for the device.
+	Status() (*Status, error)
+
+	// Apply reloads the flakey device with the spec atomically. It's used
+	// to combine features, like error_reads with corrupt_bio_byte.
+	Apply(spec FaultSpec, opts ...FeatOpt) error
+
 	// AllowWrites allows write I/O.
 	AllowWrites(opts ...FeatOpt) error
 
@@ -61,17 +237,60 @@ type Flakey interface {
 	// ErrorReads makes all read I/O is failed with an error signalled.
 	ErrorReads(opts ...FeatOpt) error
 
-	// CorruptBIOByte corruptes one byte in write bio.
-	CorruptBIOByte(nth int, read bool, value uint8, flags int, opts ...FeatOpt) error
+	// Offline fails all read and write I/O, like a dead disk or a lost
+	// controller.
+	Offline(opts ...FeatOpt) error
+
+	// CorruptBIOByte replaces the nth byte (starting from 1) of every bio
+	// in the given direction with value. Only the bio whose flags contain
+	// all the bits of flags is corrupted. Zero flags matches all the bios.
+	CorruptBIOByte(nth int, dir BIODirection, value uint8, flags BIOFlag, opts ...FeatOpt) error
 
 	// RandomReadCorrupt replaces random byte in a read bio with a random value.
+	//
+	// The probability is out of MaxProbability.
 	RandomReadCorrupt(probability int, opts ...FeatOpt) error
 
 	// RandomWriteCorrupt replaces random byte in a write bio with a random value.
+	//
+	// The probability is out of MaxProbability.
 	RandomWriteCorrupt(probability int, opts ...FeatOpt) error
 
-	// Teardown releases the flakey device.
-	Teardown() error
+	// Stall holds the device suspended so that new bios are queued, like a
+	// hung disk. The device is resumed by Unstall, or by the watchdog after
+	// duration. Transitions return ErrStalled until the device is resumed.
+	//
+	// Only WithContextFeatOpt takes effect.
+	Stall(duration time.Duration, opts ...FeatOpt) error
+
+	// Unstall resumes the stalled device. It's safe to call it from any
+	// goroutine and it's no-op if the device isn't stalled.
+	//
+	// Only WithContextFeatOpt takes effect. It bounds waiting for other
+	// transition.
+	Unstall(opts ...FeatOpt) error
+
+	// Unplug replaces the flakey table with error target, like the disk is
+	// detached. The device node stays so that the mounted filesystem sees
+	// all the I/O failed. Transitions return ErrUnplugged until Replug.
+	//
+	// Only WithContextFeatOpt takes effect.
+	Unplug(opts ...FeatOpt) error
+
+	// Replug loads the flakey table of current mode back. It's no-op if
+	// the device isn't unplugged.
+	//
+	// Only WithContextFeatOpt takes effect.
+	Replug(opts ...FeatOpt) error
+
+	// Teardown releases the flakey device. The filesystem on device must be
+	// unmounted first. Transitions return ErrTornDown only after the flakey
+	// device is removed, so the device is still usable if Teardown fails
+	// before that, and Teardown can be retried.
+	//
+	// Only WithContextFeatOpt takes effect. It bounds waiting for other
+	// transition.
+	Teardown(opts ...FeatOpt) error
 }
 
 // FSType represents the filesystem name.
@@ -89,14 +308,93 @@ var (
 	defaultInterval       = 2 * time.Minute
 )
 
+type initCfg struct {
+	// imgSize is the size of filesystem image in bytes.
+	imgSize int64
+	// loopCfg configures the loop device of image.
+	loopCfg loop.Config
+	// logicalBlockSize and physicalBlockSize are in bytes. Zero means
+	// default.
+	logicalBlockSize, physicalBlockSize int
+}
+
+var defaultInitCfg = initCfg{imgSize: defaultImgSize}
+
+// InitOpt is used to configure flakey device.
+type InitOpt func(*initCfg)
+
+// WithImgSizeInitOpt updates the size of filesystem image in bytes.
+func WithImgSizeInitOpt(size int64) InitOpt {
+	return func(cfg *initCfg) {
+		cfg.imgSize = size
+	}
+}
+
+// WithLoopConfigInitOpt configures the loop device of filesystem image, for
+// instance, enabling direct I/O to avoid caching data twice.
+func WithLoopConfigInitOpt(cfg loop.Config) InitOpt {
+	return func(c *initCfg) {
+		c.loopCfg = cfg
+	}
+}
+
+// WithBlockSizeInitOpt sets the logical and physical block size in bytes,
+// for instance, 4096 and 4096 to emulate 4K native drive, or 512 and 4096 to
+// emulate 512e drive. Both must be power of 2 between 512 and page size, and
+// the physical block size must not be less than the logical one. Zero
+// physical block size means the logical one. It overrides the block size in
+// WithLoopConfigInitOpt.
+//
+// The loop device always uses the logical block size as physical one, so the
+// smaller logical block size is emulated by dm-ebs target on loop device with
+// physical block size, which requires Linux 5.8+.
+func WithBlockSizeInitOpt(logical, physical int) InitOpt {
+	return func(cfg *initCfg) {
+		cfg.logicalBlockSize = logical
+		cfg.physicalBlockSize = physical
+	}
+}
+
 // InitFlakey creates an filesystem on a loopback device and returns Flakey on it.
 //
 // The device-mapper device will be /dev/mapper/$flakeyDevice. And the filesystem
 // image will be created at $dataStorePath/$flakeyDevice.img. By default, the
 // device is available for 2 minutes and size is 10 GiB.
-func InitFlakey(flakeyDevice, dataStorePath string, fsType FSType) (_ Flakey, retErr error) {
+func InitFlakey(flakeyDevice, dataStorePath string, fsType FSType, opts ...InitOpt) (_ Flakey, retErr error) {
+	var o = defaultInitCfg
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.logicalBlockSize != 0 || o.physicalBlockSize != 0 {
+		if err := validateBlockSize(o.logicalBlockSize, o.physicalBlockSize); err != nil {
+			return nil, err
+		}
+		if o.physicalBlockSize == 0 {
+			o.physicalBlockSize = o.logicalBlockSize
+		}
+		// NOTE: The loop device uses the logical block size as physical
+		// one. The smaller logical block size is emulated by dm-ebs.
+		o.loopCfg.BlockSize = uint32(o.physicalBlockSize)
+	}
+
+	loopBlockSize := SectorSize
+	if o.loopCfg.BlockSize != 0 {
+		loopBlockSize = int(o.loopCfg.BlockSize)
+	}
+
+	blockSize := loopBlockSize
+	if o.logicalBlockSize != 0 {
+		blockSize = o.logicalBlockSize
+	}
+
+	if o.imgSize%int64(loopBlockSize) != 0 {
+		return nil, fmt.Errorf("invalid image size %d: must be multiple of %d",
+			o.imgSize, loopBlockSize)
+	}
+
 	imgPath := filepath.Join(dataStorePath, fmt.Sprintf("%s.img", flakeyDevice))
-	if err := createEmptyFSImage(imgPath, fsType); err != nil {
+	if err := createEmptyFSImage(imgPath, fsType, o.imgSize, blockSize); err != nil {
 		return nil, err
 	}
 	defer func() {
@@ -105,22 +403,53 @@ func InitFlakey(flakeyDevice, dataStorePath string, fsType FSType) (_ Flakey, re
 		}
 	}()
 
-	loopDevice, err := attachToLoopDevice(imgPath)
+	loopFile, loopStats, err := loop.AttachWithStats(imgPath, o.loopCfg)
 	if err != nil {
 		return nil, err
 	}
+	// NOTE: The flakey device holds the loop device after it's created,
+	// so closing it doesn't trigger autoclear.
+	defer loopFile.Close()
+
+	loopDevice := loopFile.Name()
 	defer func() {
 		if retErr != nil {
-			detachLoopDevice(loopDevice)
+			loop.Detach(loopDevice)
 		}
 	}()
 
-	imgSize, err := getBlkSize(loopDevice)
+	var (
+		baseDevice = loopDevice
+		ebsDevice  string
+	)
+	if blockSize < loopBlockSize {
+		ebsDevice = fmt.Sprintf("%s-ebs", flakeyDevice)
+		if err := newEBSDevice(ebsDevice, loopDevice, blockSize, loopBlockSize); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if retErr != nil {
+				deleteFlakeyDevice(ebsDevice)
+			}
+		}()
+		baseDevice = dm.DevicePath(ebsDevice)
+	}
+
+	imgSize, err := getBlkSize(baseDevice)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := newFlakeyDevice(flakeyDevice, loopDevice, defaultInterval); err != nil {
+	logical, physical, err := getBlkSectorSizes(baseDevice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device %s block size: %w", baseDevice, err)
+	}
+	if logical != blockSize || physical != loopBlockSize {
+		return nil, fmt.Errorf("device %s uses logical/physical block size %d/%d instead of %d/%d",
+			baseDevice, logical, physical, blockSize, loopBlockSize)
+	}
+
+	if err := newFlakeyDevice(flakeyDevice, baseDevice, defaultInterval); err != nil {
 		return nil, err
 	}
 
@@ -129,8 +458,17 @@ func InitFlakey(flakeyDevice, dataStorePath string, fsType FSType) (_ Flakey, re
 		imgPath: imgPath,
 		imgSize: imgSize,
 
+		logicalBlockSize:  logical,
+		physicalBlockSize: physical,
+
 		loopDevice:   loopDevice,
+		loopStats:    loopStats,
+		ebsDevice:    ebsDevice,
+		baseDevice:   baseDevice,
 		flakeyDevice: flakeyDevice,
+
+		transitionMu: make(chan struct{}, 1),
+		mode:         FaultSpec{UpInterval: defaultInterval},
 	}, nil
 }
 
@@ -139,8 +477,87 @@ type flakey struct {
 	imgPath string
 	imgSize int64
 
-	loopDevice   string
+	logicalBlockSize  int
+	physicalBlockSize int
+
+	loopDevice string
+	loopStats  loop.AttachStats
+	// ebsDevice is the dm-ebs device name on loop device if the logical
+	// block size is smaller than physical one. Otherwise, it's empty.
+	ebsDevice string
+	// baseDevice is the device under flakey device, which is the loop
+	// device or ebs device.
+	baseDevice   string
 	flakeyDevice string
+
+	// transitionMu serializes transitions and teardown. It's a channel so
+	// that waiting can be aborted by context.
+	transitionMu chan struct{}
+	// tornDown is protected by transitionMu.
+	tornDown bool
+	// stall is protected by transitionMu. It's not nil if device is
+	// stalled.
+	stall *stall
+	// unplugged is protected by transitionMu.
+	unplugged bool
+
+	// mu protects mode and history.
+	mu      sync.Mutex
+	mode    FaultSpec
+	history []Transition
+}
+
+// stall is the state of stalled device.
+type stall struct {
+	// watchdog resumes the device after the stall duration.
+	watchdog *time.Timer
+}
+
+// TransitionAction is the kind of transition.
+type TransitionAction string
+
+// Supported transition actions.
+const (
+	// TransitionLoad loads the fault spec, like DropWrites and Apply.
+	TransitionLoad TransitionAction = "load"
+	// TransitionStall suspends the device by Stall.
+	TransitionStall TransitionAction = "stall"
+	// TransitionUnstall resumes the stalled device by Unstall, Teardown or
+	// watchdog.
+	TransitionUnstall TransitionAction = "unstall"
+	// TransitionUnplug replaces the flakey table with error target.
+	TransitionUnplug TransitionAction = "unplug"
+	// TransitionReplug loads the flakey table back.
+	TransitionReplug TransitionAction = "replug"
+)
+
+// maxHistory is the number of latest transitions kept by Flakey, so that the
+// long-running schedule, like chaos, doesn't grow history without limit.
+const maxHistory = 1024
+
+// Transition records one reload of flakey device.
+type Transition struct {
+	// Action is the kind of transition.
+	Action TransitionAction
+	// Time is when the reload is started.
+	Time time.Time
+	// Duration is how long the reload takes.
+	Duration time.Duration
+	// Spec is the spec to load. It's the current mode if the action isn't
+	// TransitionLoad, since the mode is unchanged.
+	Spec FaultSpec
+	// Err is the reload error. The device keeps the previous mode if it's
+	// not nil.
+	Err error
+}
+
+// String returns the transition in one line.
+func (t Transition) String() string {
+	res := fmt.Sprintf("%s (+%v) %s %s", t.Time.Format(time.RFC3339Nano), t.Duration, t.Action, t.Spec.describe())
+	if t.Err != nil {
+		res += fmt.Sprintf(" failed: %v", t.Err)
+	}
+	return res
 }
 
 // DevicePath returns the flakey device path.
@@ -148,78 +565,397 @@ func (f *flakey) DevicePath() string {
 	return fmt.Sprintf("/dev/mapper/%s", f.flakeyDevice)
 }
 
+// LoopAttachStats returns how the loop device was attached.
+func (f *flakey) LoopAttachStats() loop.AttachStats {
+	return f.loopStats
+}
+
+// LogicalBlockSize returns the logical block size in bytes.
+func (f *flakey) LogicalBlockSize() int {
+	return f.logicalBlockSize
+}
+
+// PhysicalBlockSize returns the physical block size in bytes.
+func (f *flakey) PhysicalBlockSize() int {
+	return f.physicalBlockSize
+}
+
 // Filesystem returns filesystem's type.
 func (f *flakey) Filesystem() FSType {
 	return f.fsType
 }
 
+// Mode returns the spec loaded by the last successful transition.
+func (f *flakey) Mode() FaultSpec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.mode.clone()
+}
+
+// History returns the latest transitions, including failed ones, in order.
+func (f *flakey) History() []Transition {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	history := make([]Transition, len(f.history))
+	for i, t := range f.history {
+		t.Spec = t.Spec.clone()
+		history[i] = t
+	}
+	return history
+}
+
+// Status returns what the kernel is actually running for the device. It
+// doesn't wait for in-flight transition.
+func (f *flakey) Status() (*Status, error) {
+	return getDeviceStatus(f.flakeyDevice)
+}
+
+// Apply reloads the flakey device with the spec atomically.
+//
+// Only WithContextFeatOpt and WithSyncFSFeatOpt take effect. Intervals come
+// from the spec.
+func (f *flakey) Apply(spec FaultSpec, opts ...FeatOpt) error {
+	var o = defaultFeatCfg
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return f.apply(o.ctx, spec, o.syncFS)
+}
+
 // AllowWrites allows write I/O.
 func (f *flakey) AllowWrites(opts ...FeatOpt) error {
+	return f.applyFeatures(opts)
+}
+
+// DropWrites drops all write I/O silently.
+func (f *flakey) DropWrites(opts ...FeatOpt) error {
+	return f.applyFeatures(opts, DropWritesFeature{})
+}
+
+// ErrorWrites drops all write I/O and returns error.
+func (f *flakey) ErrorWrites(opts ...FeatOpt) error {
+	return f.applyFeatures(opts, ErrorWritesFeature{})
+}
+
+// ErrorReads makes all read I/O is failed with an error signalled.
+func (f *flakey) ErrorReads(opts ...FeatOpt) error {
+	return f.applyFeatures(opts, ErrorReadsFeature{})
+}
+
+// Offline fails all read and write I/O.
+//
+// dm-flakey fails all the I/O in down interval if there is no feature.
+func (f *flakey) Offline(opts ...FeatOpt) error {
 	var o = defaultFeatCfg
 	for _, opt := range opts {
 		opt(&o)
 	}
+	return f.apply(o.ctx, o.offlineSpec(), o.syncFS)
+}
 
-	table := fmt.Sprintf("0 %d flakey %s 0 %d 0",
-		f.imgSize, f.loopDevice, int(o.interval.Seconds()))
+// CorruptBIOByte replaces the nth byte (starting from 1) of every bio in the
+// given direction with value.
+func (f *flakey) CorruptBIOByte(nth int, dir BIODirection, value uint8, flags BIOFlag, opts ...FeatOpt) error {
+	return f.applyFeatures(opts, CorruptBIOByteFeature{
+		Nth:       nth,
+		Direction: dir,
+		Value:     value,
+		Flags:     flags,
+	})
+}
 
-	return reloadFlakeyDevice(f.flakeyDevice, o.syncFS, table)
+// RandomReadCorrupt replaces random byte in a read bio with a random value.
+func (f *flakey) RandomReadCorrupt(probability int, opts ...FeatOpt) error {
+	return f.applyFeatures(opts, RandomReadCorruptFeature{Probability: probability})
 }
 
-// DropWrites drops all write I/O silently.
-func (f *flakey) DropWrites(opts ...FeatOpt) error {
+// RandomWriteCorrupt replaces random byte in a write bio with a random value.
+func (f *flakey) RandomWriteCorrupt(probability int, opts ...FeatOpt) error {
+	return f.applyFeatures(opts, RandomWriteCorruptFeature{Probability: probability})
+}
+
+// applyFeatures reloads the flakey device with features and intervals from
+// options.
+func (f *flakey) applyFeatures(opts []FeatOpt, features ...Feature) error {
 	var o = defaultFeatCfg
 	for _, opt := range opts {
 		opt(&o)
 	}
+	return f.apply(o.ctx, o.spec(features...), o.syncFS)
+}
+
+// apply reloads the flakey device with the spec.
+func (f *flakey) apply(ctx context.Context, spec FaultSpec, syncFS bool) error {
+	table, err := buildFlakeyTable(f.imgSize, f.logicalBlockSize, f.baseDevice, spec)
+	if err != nil {
+		return err
+	}
+
+	for _, feat := range spec.Features {
+		if err := checkFeatureSupport(feat.Name()); err != nil {
+			return err
+		}
+	}
+
+	if err := f.lockTransition(ctx); err != nil {
+		return err
+	}
+	defer f.unlockTransition()
 
-	table := fmt.Sprintf("0 %d flakey %s 0 0 %d 1 drop_writes",
-		f.imgSize, f.loopDevice, int(o.interval.Seconds()))
+	if f.tornDown {
+		return ErrTornDown
+	}
+	if f.stall != nil {
+		return ErrStalled
+	}
+	if f.unplugged {
+		return ErrUnplugged
+	}
 
-	return reloadFlakeyDevice(f.flakeyDevice, o.syncFS, table)
+	start := time.Now()
+	err = reloadFlakeyDevice(ctx, f.flakeyDevice, syncFS, table)
+	f.record(Transition{Action: TransitionLoad, Time: start, Duration: time.Since(start), Spec: spec, Err: err})
+	return err
 }
 
-// ErrorWrites drops all write I/O and returns error.
-func (f *flakey) ErrorWrites(opts ...FeatOpt) error {
+// lockTransition waits for other transition or teardown.
+func (f *flakey) lockTransition(ctx context.Context) error {
+	// NOTE: select picks one randomly if both are ready.
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to wait for other transition: %w", err)
+	}
+
+	select {
+	case f.transitionMu <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to wait for other transition: %w", ctx.Err())
+	}
+}
+
+// unlockTransition allows next transition or teardown.
+func (f *flakey) unlockTransition() {
+	<-f.transitionMu
+}
+
+// Stall holds the device suspended for duration.
+func (f *flakey) Stall(duration time.Duration, opts ...FeatOpt) error {
+	if duration <= 0 {
+		return fmt.Errorf("invalid stall duration %v: must be positive", duration)
+	}
+
 	var o = defaultFeatCfg
 	for _, opt := range opts {
 		opt(&o)
 	}
 
-	table := fmt.Sprintf("0 %d flakey %s 0 0 %d 1 error_writes",
-		f.imgSize, f.loopDevice, int(o.interval.Seconds()))
+	if err := f.lockTransition(o.ctx); err != nil {
+		return err
+	}
+	defer f.unlockTransition()
+
+	if f.tornDown {
+		return ErrTornDown
+	}
+	if f.stall != nil {
+		return ErrStalled
+	}
+	if f.unplugged {
+		return ErrUnplugged
+	}
 
-	return reloadFlakeyDevice(f.flakeyDevice, o.syncFS, table)
+	// NOTE: --nolockfs keeps filesystem unfrozen so that in-flight and new
+	// bios are queued in device-mapper instead of blocking in freeze.
+	start := time.Now()
+	err := suspendFlakeyDevice(o.ctx, f.flakeyDevice, false)
+	if err != nil {
+		if rerr := resumeFlakeyDevice(f.flakeyDevice); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+		err = fmt.Errorf("failed to stall flakey device %s: %w", f.flakeyDevice, err)
+	}
+	f.record(Transition{Action: TransitionStall, Time: start, Duration: time.Since(start), Spec: f.Mode(), Err: err})
+	if err != nil {
+		return err
+	}
+
+	st := &stall{}
+	st.watchdog = time.AfterFunc(duration, func() {
+		f.transitionMu <- struct{}{}
+		defer f.unlockTransition()
+
+		// stall might be released and started again
+		if f.stall == st {
+			// NOTE: the device stays stalled if it fails. Unstall or
+			// Teardown can retry.
+			_ = f.unstall()
+		}
+	})
+	f.stall = st
+	return nil
 }
 
-// ErrorReads makes all read I/O is failed with an error signalled.
-func (f *flakey) ErrorReads(opts ...FeatOpt) error {
-	return errors.New("not implemented")
+// Unstall resumes the stalled device.
+func (f *flakey) Unstall(opts ...FeatOpt) error {
+	var o = defaultFeatCfg
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := f.lockTransition(o.ctx); err != nil {
+		return err
+	}
+	defer f.unlockTransition()
+
+	return f.unstall()
+}
+
+// unstall resumes the stalled device. It must be called with transitionMu.
+func (f *flakey) unstall() error {
+	if f.stall == nil {
+		return nil
+	}
+
+	f.stall.watchdog.Stop()
+
+	start := time.Now()
+	err := resumeFlakeyDevice(f.flakeyDevice)
+	if err != nil {
+		err = fmt.Errorf("failed to unstall flakey device %s: %w", f.flakeyDevice, err)
+	}
+	f.record(Transition{Action: TransitionUnstall, Time: start, Duration: time.Since(start), Spec: f.Mode(), Err: err})
+	if err != nil {
+		return err
+	}
+	f.stall = nil
+	return nil
 }
 
-// CorruptBIOByte corruptes one byte in write bio.
-func (f *flakey) CorruptBIOByte(nth int, read bool, value uint8, flags int, opts ...FeatOpt) error {
-	return errors.New("not implemented")
+// Unplug replaces the flakey table with error target.
+func (f *flakey) Unplug(opts ...FeatOpt) error {
+	var o = defaultFeatCfg
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := f.lockTransition(o.ctx); err != nil {
+		return err
+	}
+	defer f.unlockTransition()
+
+	if f.tornDown {
+		return ErrTornDown
+	}
+	if f.stall != nil {
+		return ErrStalled
+	}
+	if f.unplugged {
+		return ErrUnplugged
+	}
+
+	start := time.Now()
+	err := reloadFlakeyDevice(o.ctx, f.flakeyDevice, false, buildErrorTable(f.imgSize))
+	if err != nil {
+		err = fmt.Errorf("failed to unplug flakey device %s: %w", f.flakeyDevice, err)
+	}
+	f.record(Transition{Action: TransitionUnplug, Time: start, Duration: time.Since(start), Spec: f.Mode(), Err: err})
+	if err != nil {
+		return err
+	}
+	f.unplugged = true
+	return nil
 }
 
-// RandomReadCorrupt replaces random byte in a read bio with a random value.
-func (f *flakey) RandomReadCorrupt(probability int, opts ...FeatOpt) error {
-	return errors.New("not implemented")
+// Replug loads the flakey table of current mode back.
+func (f *flakey) Replug(opts ...FeatOpt) error {
+	var o = defaultFeatCfg
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := f.lockTransition(o.ctx); err != nil {
+		return err
+	}
+	defer f.unlockTransition()
+
+	if f.tornDown {
+		return ErrTornDown
+	}
+	if !f.unplugged {
+		return nil
+	}
+
+	mode := f.Mode()
+	table, err := buildFlakeyTable(f.imgSize, f.logicalBlockSize, f.baseDevice, mode)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = reloadFlakeyDevice(o.ctx, f.flakeyDevice, false, table)
+	if err != nil {
+		err = fmt.Errorf("failed to replug flakey device %s: %w", f.flakeyDevice, err)
+	}
+	f.record(Transition{Action: TransitionReplug, Time: start, Duration: time.Since(start), Spec: mode, Err: err})
+	if err != nil {
+		return err
+	}
+	f.unplugged = false
+	return nil
 }
 
-// RandomWriteCorrupt replaces random byte in a write bio with a random value.
-func (f *flakey) RandomWriteCorrupt(probability int, opts ...FeatOpt) error {
-	return errors.New("not implemented")
+// record appends the transition into history and updates mode if it loads
+// spec successfully. Only the latest maxHistory transitions are kept.
+func (f *flakey) record(t Transition) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.history) >= maxHistory {
+		f.history = f.history[len(f.history)-maxHistory+1:]
+	}
+	t.Spec = t.Spec.clone()
+	f.history = append(f.history, t)
+	if t.Action == TransitionLoad && t.Err == nil {
+		f.mode = t.Spec
+	}
 }
 
-// Teardown releases the flakey device.
-func (f *flakey) Teardown() error {
+// Teardown releases the flakey device. It waits for in-flight transition and
+// it's safe to retry if it fails.
+func (f *flakey) Teardown(opts ...FeatOpt) error {
+	var o = defaultFeatCfg
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := f.lockTransition(o.ctx); err != nil {
+		return err
+	}
+	defer f.unlockTransition()
+
+	// queued bios must be completed before removing device
+	if err := f.unstall(); err != nil {
+		return err
+	}
+
 	if err := deleteFlakeyDevice(f.flakeyDevice); err != nil {
-		if !strings.Contains(err.Error(), "No such device or address") {
+		if !isDeviceNotExist(err) {
 			return err
 		}
 	}
-	if err := detachLoopDevice(f.loopDevice); err != nil {
+
+	// The flakey device is still usable if it fails to be removed.
+	f.tornDown = true
+	if f.ebsDevice != "" {
+		if err := deleteFlakeyDevice(f.ebsDevice); err != nil {
+			if !isDeviceNotExist(err) {
+				return err
+			}
+		}
+	}
+	if err := loop.Detach(f.loopDevice); err != nil {
 		if !errors.Is(err, unix.ENXIO) {
 			return err
 		}
@@ -228,12 +964,17 @@ func (f *flakey) Teardown() error {
 }
 
 // createEmptyFSImage creates empty filesystem on dataStorePath folder with
-// default size - 10 GiB.
-func createEmptyFSImage(imgPath string, fsType FSType) error {
+// given size.
+func createEmptyFSImage(imgPath string, fsType FSType, imgSize int64, blockSize int) error {
 	if err := validateFSType(fsType); err != nil {
 		return err
 	}
 
+	if imgSize <= 0 || imgSize%int64(blockSize) != 0 {
+		return fmt.Errorf("invalid image size %d: must be positive multiple of %d",
+			imgSize, blockSize)
+	}
+
 	mkfs, err := exec.LookPath(fmt.Sprintf("mkfs.%s", fsType))
 	if err != nil {
 		return fmt.Errorf("failed to ensure mkfs.%s: %w", fsType, err)
@@ -251,13 +992,14 @@ func createEmptyFSImage(imgPath string, fsType FSType) error {
 	if err = func() error {
 		defer f.Close()
 
-		return f.Truncate(defaultImgSize)
+		return f.Truncate(imgSize)
 	}(); err != nil {
 		return fmt.Errorf("failed to truncate image %s with %v bytes: %w",
-			imgPath, defaultImgSize, err)
+			imgPath, imgSize, err)
 	}
 
-	output, err := exec.Command(mkfs, imgPath).CombinedOutput()
+	args := append(mkfsBlockSizeArgs(fsType, blockSize), imgPath)
+	output, err := exec.Command(mkfs, args...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to mkfs.%s on %s (out: %s): %w",
 			fsType, imgPath, string(output), err)
@@ -265,6 +1007,34 @@ func createEmptyFSImage(imgPath string, fsType FSType) error {
 	return nil
 }
 
+// mkfsBlockSizeArgs returns the mkfs arguments for the logical block size.
+// The image is created before loop device, so mkfs doesn't know the logical
+// block size and the filesystem can't be mounted if its block or sector size
+// is smaller than that.
+func mkfsBlockSizeArgs(fsType FSType, blockSize int) []string {
+	switch {
+	case fsType == FSTypeEXT4 && blockSize > 1024:
+		return []string{"-b", strconv.Itoa(blockSize)}
+	case fsType == FSTypeXFS && blockSize > SectorSize:
+		return []string{"-s", fmt.Sprintf("size=%d", blockSize)}
+	default:
+		return nil
+	}
+}
+
+// validateBlockSize validates the logical and physical block size.
+func validateBlockSize(logical, physical int) error {
+	if logical < SectorSize || logical > os.Getpagesize() || logical&(logical-1) != 0 {
+		return fmt.Errorf("invalid logical block size %d: must be power of 2 between %d and %d",
+			logical, SectorSize, os.Getpagesize())
+	}
+	if physical != 0 && (physical < logical || physical > os.Getpagesize() || physical&(physical-1) != 0) {
+		return fmt.Errorf("invalid physical block size %d: must be power of 2 between %d and %d",
+			physical, logical, os.Getpagesize())
+	}
+	return nil
+}
+
 // validateFSType validates the fs type input.
 func validateFSType(fsType FSType) error {
 	switch fsType {
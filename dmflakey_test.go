@@ -3,14 +3,20 @@
 package dmflakey
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/fuweid/go-dmflakey/dm"
+	"github.com/fuweid/go-dmflakey/loop"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sys/unix"
@@ -109,13 +115,997 @@ func TestErrorWrites(t *testing.T) {
 	assert.Equal(t, "hello, world", string(data))
 }
 
-func initFlakey(t *testing.T, fsType FSType) (_ Flakey, root string) {
+func TestErrorReads(t *testing.T) {
+	flakey, root := initFlakey(t, FSTypeEXT4)
+
+	// commit=1000 is to delay commit triggered by writeback thread
+	require.NoError(t, mount(root, flakey.DevicePath(), "commit=1000"))
+
+	f1 := filepath.Join(root, "f1")
+	require.NoError(t, writeFile(f1, bytes.Repeat([]byte("A"), 4096), 0600, true))
+
+	// O_DIRECT bypasses page cache so that I/O always reaches the device.
+	f, err := os.OpenFile(f1, os.O_RDWR|unix.O_DIRECT, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := alignedBlock(t)
+
+	// inject IO failure on read
+	err = flakey.ErrorReads()
+	if errors.Is(err, ErrUnsupportedByKernel) {
+		t.Skipf("skip: %v", err)
+	}
+	require.NoError(t, err)
+
+	_, err = f.ReadAt(buf, 0)
+	assert.ErrorContains(t, err, "input/output error")
+
+	// write IO is still handled correctly
+	copy(buf, bytes.Repeat([]byte("B"), len(buf)))
+	_, err = f.WriteAt(buf, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Sync())
+
+	// resume
+	assert.NoError(t, flakey.AllowWrites())
+
+	copy(buf, make([]byte, len(buf)))
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("B"), len(buf)), buf)
+}
+
+func TestOffline(t *testing.T) {
+	t.Run("ext4", func(t *testing.T) {
+		testOffline(t, FSTypeEXT4, "errors=remount-ro", func(t *testing.T, root string) {
+			// ext4 aborts journal and remounts filesystem readonly
+			assert.Eventually(t, func() bool {
+				var st unix.Statfs_t
+				return unix.Statfs(root, &st) == nil && st.Flags&unix.ST_RDONLY != 0
+			}, 10*time.Second, 100*time.Millisecond)
+
+			err := os.WriteFile(filepath.Join(root, "f2"), nil, 0600)
+			assert.ErrorIs(t, err, unix.EROFS)
+		})
+	})
+
+	t.Run("xfs", func(t *testing.T) {
+		if _, err := exec.LookPath("mkfs.xfs"); err != nil {
+			t.Skipf("skip: %v", err)
+		}
+
+		testOffline(t, FSTypeXFS, "", func(t *testing.T, root string) {
+			// xfs shuts down filesystem on log I/O error
+			err := os.WriteFile(filepath.Join(root, "f2"), nil, 0600)
+			assert.ErrorIs(t, err, unix.EIO)
+		})
+	})
+}
+
+func testOffline(t *testing.T, fsType FSType, mntOpt string, check func(t *testing.T, root string)) {
+	flakey, root := initFlakey(t, fsType)
+
+	require.NoError(t, mount(root, flakey.DevicePath(), mntOpt))
+
+	f1 := filepath.Join(root, "f1")
+	require.NoError(t, writeFile(f1, bytes.Repeat([]byte("A"), 4096), 0600, true))
+
+	// O_DIRECT bypasses page cache so that I/O always reaches the device.
+	f, err := os.OpenFile(f1, os.O_RDWR|unix.O_DIRECT, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := alignedBlock(t)
+
+	require.NoError(t, flakey.Offline())
+	assert.Empty(t, flakey.Mode().Features)
+
+	// both read and write I/O fail
+	_, err = f.ReadAt(buf, 0)
+	assert.ErrorContains(t, err, "input/output error")
+
+	_, err = f.WriteAt(buf, 0)
+	assert.ErrorContains(t, err, "input/output error")
+
+	// metadata update can't reach journal
+	require.NoError(t, writeFile(filepath.Join(root, "f1.meta"), []byte("A"), 0600, false))
+	assert.Error(t, syncfs(f1))
+
+	check(t, root)
+}
+
+func TestCorruptBIOByte(t *testing.T) {
+	flakey, root := initFlakey(t, FSTypeEXT4)
+
+	// commit=1000 is to delay commit triggered by writeback thread
+	require.NoError(t, mount(root, flakey.DevicePath(), "commit=1000"))
+
+	f1 := filepath.Join(root, "f1")
+	require.NoError(t, writeFile(f1, bytes.Repeat([]byte("A"), 4096), 0600, true))
+
+	// O_DIRECT bypasses page cache so that I/O always reaches the device.
+	f, err := os.OpenFile(f1, os.O_RDONLY|unix.O_DIRECT, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := alignedBlock(t)
+
+	// corrupt the first byte of each read bio
+	assert.NoError(t, flakey.CorruptBIOByte(1, BIORead, 'B', 0))
+
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, byte('B'), buf[0])
+	assert.Equal(t, bytes.Repeat([]byte("A"), len(buf)-1), buf[1:])
+
+	// REQ_META is only set by filesystem metadata reads
+	assert.NoError(t, flakey.CorruptBIOByte(1, BIORead, 'B', BIOFlagMeta))
+
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("A"), len(buf)), buf)
+
+	// resume
+	assert.NoError(t, flakey.AllowWrites())
+
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("A"), len(buf)), buf)
+
+	assert.Error(t, flakey.CorruptBIOByte(0, BIORead, 'B', 0))
+	assert.Error(t, flakey.CorruptBIOByte(1, BIODirection("x"), 'B', 0))
+}
+
+func TestRandomReadCorrupt(t *testing.T) {
+	flakey, root := initFlakey(t, FSTypeEXT4)
+
+	// commit=1000 is to delay commit triggered by writeback thread
+	require.NoError(t, mount(root, flakey.DevicePath(), "commit=1000"))
+
+	f1 := filepath.Join(root, "f1")
+	require.NoError(t, writeFile(f1, bytes.Repeat([]byte("A"), 4096), 0600, true))
+
+	// O_DIRECT bypasses page cache so that I/O always reaches the device.
+	f, err := os.OpenFile(f1, os.O_RDONLY|unix.O_DIRECT, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := alignedBlock(t)
+
+	assert.Error(t, flakey.RandomReadCorrupt(-1))
+	assert.Error(t, flakey.RandomReadCorrupt(MaxProbability+1))
+
+	err = flakey.RandomReadCorrupt(MaxProbability)
+	if errors.Is(err, ErrUnsupportedByKernel) {
+		t.Skipf("skip: %v", err)
+	}
+	require.NoError(t, err)
+
+	// random value might be the same as the original one
+	corrupted := false
+	for i := 0; i < 10 && !corrupted; i++ {
+		_, err = f.ReadAt(buf, 0)
+		assert.NoError(t, err)
+		corrupted = !bytes.Equal(bytes.Repeat([]byte("A"), len(buf)), buf)
+	}
+	assert.True(t, corrupted, "read bio should be corrupted")
+
+	// resume
+	assert.NoError(t, flakey.AllowWrites())
+
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("A"), len(buf)), buf)
+}
+
+func TestFlappingErrorWrites(t *testing.T) {
+	flakey, root := initFlakey(t, FSTypeEXT4)
+
+	// commit=1000 is to delay commit triggered by writeback thread
+	require.NoError(t, mount(root, flakey.DevicePath(), "commit=1000"))
+
+	f1 := filepath.Join(root, "f1")
+	require.NoError(t, writeFile(f1, bytes.Repeat([]byte("A"), 4096), 0600, true))
+
+	// O_DIRECT bypasses page cache so that I/O always reaches the device.
+	f, err := os.OpenFile(f1, os.O_WRONLY|unix.O_DIRECT, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := alignedBlock(t)
+
+	// available for 3 seconds and then fail writes for 3 seconds, over and over
+	start := time.Now()
+	require.NoError(t, flakey.ErrorWrites(
+		WithUpIntervalFeatOpt(3*time.Second),
+		WithDownIntervalFeatOpt(3*time.Second),
+	))
+
+	for _, tc := range []struct {
+		at     time.Duration
+		hasErr bool
+	}{
+		{at: 1 * time.Second},
+		{at: 4500 * time.Millisecond, hasErr: true},
+		{at: 7500 * time.Millisecond},
+	} {
+		time.Sleep(time.Until(start.Add(tc.at)))
+
+		_, err = f.WriteAt(buf, 0)
+		if tc.hasErr {
+			assert.ErrorContains(t, err, "input/output error", "write at %v", tc.at)
+			continue
+		}
+		assert.NoError(t, err, "write at %v", tc.at)
+	}
+
+	assert.NoError(t, flakey.AllowWrites())
+}
+
+func TestFeatCfgSpec(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []FeatOpt
+		features []Feature
+		expected string
+		hasErr   bool
+	}{
+		{name: "default up", expected: "120 0"},
+		{
+			name:     "default down",
+			features: []Feature{DropWritesFeature{}},
+			expected: "0 120 1 drop_writes",
+		},
+		{
+			name:     "interval",
+			opts:     []FeatOpt{WithIntervalFeatOpt(time.Minute)},
+			features: []Feature{ErrorWritesFeature{}},
+			expected: "0 60 1 error_writes",
+		},
+		{
+			name: "flapping",
+			opts: []FeatOpt{
+				WithUpIntervalFeatOpt(10 * time.Second),
+				WithDownIntervalFeatOpt(5 * time.Second),
+			},
+			features: []Feature{ErrorWritesFeature{}},
+			expected: "10 5 1 error_writes",
+		},
+		{
+			name:     "zero",
+			opts:     []FeatOpt{WithIntervalFeatOpt(500 * time.Millisecond)},
+			features: []Feature{ErrorWritesFeature{}},
+			hasErr:   true,
+		},
+		{
+			name:   "negative",
+			opts:   []FeatOpt{WithDownIntervalFeatOpt(-time.Second)},
+			hasErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var o = defaultFeatCfg
+			for _, opt := range tc.opts {
+				opt(&o)
+			}
+
+			args, err := o.spec(tc.features...).args()
+			if tc.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, strings.Join(args, " "))
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	flakey, root := initFlakey(t, FSTypeEXT4)
+
+	// commit=1000 is to delay commit triggered by writeback thread
+	require.NoError(t, mount(root, flakey.DevicePath(), "commit=1000"))
+
+	f1 := filepath.Join(root, "f1")
+	require.NoError(t, writeFile(f1, bytes.Repeat([]byte("A"), 4096), 0600, true))
+
+	// O_DIRECT bypasses page cache so that I/O always reaches the device.
+	f, err := os.OpenFile(f1, os.O_RDWR|unix.O_DIRECT, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := alignedBlock(t)
+
+	// corrupt the first byte of each read bio and fail all the writes
+	require.NoError(t, flakey.Apply(FaultSpec{
+		DownInterval: time.Minute,
+		Features: []Feature{
+			ErrorWritesFeature{},
+			CorruptBIOByteFeature{Nth: 1, Direction: BIORead, Value: 'B'},
+		},
+	}))
+
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, byte('B'), buf[0])
+
+	_, err = f.WriteAt(buf, 0)
+	assert.ErrorContains(t, err, "input/output error")
+
+	// conflicting features are rejected before reload
+	assert.Error(t, flakey.Apply(FaultSpec{
+		DownInterval: time.Minute,
+		Features:     []Feature{DropWritesFeature{}, ErrorWritesFeature{}},
+	}))
+
+	// resume
+	assert.NoError(t, flakey.Apply(FaultSpec{UpInterval: time.Minute}))
+
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("A"), len(buf)), buf)
+}
+
+func TestErrorWritesInSectorRange(t *testing.T) {
+	flakey, _ := initFlakey(t, FSTypeEXT4)
+
+	// the second GiB fails write I/O and the rest is healthy
+	faulty := SectorRange{Start: 1 << 21, Length: 1 << 21}
+	require.NoError(t, flakey.ErrorWrites(WithSectorRangesFeatOpt(faulty)))
+
+	// O_DIRECT bypasses page cache so that I/O always reaches the device.
+	dev, err := os.OpenFile(flakey.DevicePath(), os.O_RDWR|unix.O_DIRECT, 0)
+	require.NoError(t, err)
+	defer dev.Close()
+
+	buf := alignedBlock(t)
+
+	for _, tc := range []struct {
+		sector int64
+		hasErr bool
+	}{
+		{sector: faulty.Start - 8},
+		{sector: faulty.Start, hasErr: true},
+		{sector: faulty.End() - 8, hasErr: true},
+		{sector: faulty.End()},
+	} {
+		_, err = dev.WriteAt(buf, tc.sector*SectorSize)
+		if tc.hasErr {
+			assert.ErrorContains(t, err, "input/output error", "sector %d", tc.sector)
+			continue
+		}
+		assert.NoError(t, err, "sector %d", tc.sector)
+	}
+
+	// restore one healthy segment
+	require.NoError(t, flakey.AllowWrites())
+
+	_, err = dev.WriteAt(buf, faulty.Start*SectorSize)
+	assert.NoError(t, err)
+}
+
+func TestCorruptFileByMapFile(t *testing.T) {
+	flakey, root := initFlakey(t, FSTypeEXT4)
+
+	// commit=1000 is to delay commit triggered by writeback thread
+	require.NoError(t, mount(root, flakey.DevicePath(), "commit=1000"))
+
+	f1, f2 := filepath.Join(root, "f1"), filepath.Join(root, "f2")
+	require.NoError(t, writeFile(f1, bytes.Repeat([]byte("A"), 1<<20), 0600, true))
+	require.NoError(t, writeFile(f2, bytes.Repeat([]byte("A"), 1<<20), 0600, true))
+
+	extents, err := MapFile(flakey, f1)
+	require.NoError(t, err)
+	require.NotEmpty(t, extents.Ranges)
+	assert.False(t, extents.Delalloc)
+
+	_, err = MapFile(flakey, t.TempDir())
+	assert.Error(t, err, "file is not on flakey device")
+
+	// corrupt the first byte of each read bio on f1
+	require.NoError(t, flakey.CorruptBIOByte(1, BIORead, 'B', 0,
+		WithSectorRangesFeatOpt(extents.Ranges...)))
+
+	buf := alignedBlock(t)
+	for file, corrupted := range map[string]bool{f1: true, f2: false} {
+		// O_DIRECT bypasses page cache so that I/O always reaches the device.
+		f, err := os.OpenFile(file, os.O_RDONLY|unix.O_DIRECT, 0600)
+		require.NoError(t, err)
+
+		_, err = f.ReadAt(buf, 0)
+		f.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, corrupted, buf[0] == 'B', "file %s", file)
+	}
+}
+
+func TestErrorWritesOnJournal(t *testing.T) {
+	flakey, root := initFlakey(t, FSTypeEXT4)
+
+	// commit=1000 is to delay commit triggered by writeback thread
+	require.NoError(t, mount(root, flakey.DevicePath(), "commit=1000"))
+
+	f1 := filepath.Join(root, "f1")
+	require.NoError(t, writeFile(f1, bytes.Repeat([]byte("A"), 4096), 0600, true))
+
+	// O_DIRECT bypasses page cache so that I/O always reaches the device.
+	f, err := os.OpenFile(f1, os.O_WRONLY|unix.O_DIRECT, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	regions, err := GetMetadataRegions(flakey)
+	require.NoError(t, err)
+
+	journal := regions.Ranges(MetadataJournal)
+	require.NotEmpty(t, journal)
+
+	// only the jbd2 journal fails write I/O
+	require.NoError(t, flakey.ErrorWrites(WithSectorRangesFeatOpt(journal...)))
+
+	// overwrite data block doesn't touch journal
+	buf := alignedBlock(t)
+	_, err = f.WriteAt(buf, 0)
+	assert.NoError(t, err)
+
+	// new file requires journal commit
+	err = writeFile(filepath.Join(root, "f2"), []byte("hello"), 0600, true)
+	assert.Error(t, err)
+}
+
+func TestModeAndHistory(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	flakey, err := InitFlakey("go-dmflakey", tmpDir, FSTypeEXT4)
+	require.NoError(t, err, "init flakey")
+	defer flakey.Teardown()
+
+	assert.Equal(t, FaultSpec{UpInterval: defaultInterval}, flakey.Mode())
+	assert.Empty(t, flakey.History())
+
+	require.NoError(t, flakey.DropWrites())
+	assert.Equal(t, FaultSpec{
+		DownInterval: defaultInterval,
+		Features:     []Feature{DropWritesFeature{}},
+	}, flakey.Mode())
+
+	// invalid spec doesn't reach device
+	require.Error(t, flakey.CorruptBIOByte(0, BIORead, 0, 0))
+	require.Len(t, flakey.History(), 1)
+
+	// remove device behind flakey so that reload fails
+	require.NoError(t, deleteFlakeyDevice("go-dmflakey"))
+
+	// failed reload keeps previous mode
+	require.Error(t, flakey.AllowWrites())
+	assert.Equal(t, []Feature{DropWritesFeature{}}, flakey.Mode().Features)
+
+	history := flakey.History()
+	require.Len(t, history, 2)
+	assert.NoError(t, history[0].Err)
+	assert.Error(t, history[1].Err)
+	assert.Equal(t, FaultSpec{UpInterval: defaultInterval}, history[1].Spec)
+	assert.Contains(t, history[1].String(), "failed")
+
+	require.NoError(t, flakey.Teardown())
+
+	// no reload after teardown
+	assert.ErrorIs(t, flakey.AllowWrites(), ErrTornDown)
+	assert.Len(t, flakey.History(), 2)
+}
+
+func TestConcurrentTransitions(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	flakey, err := InitFlakey("go-dmflakey", tmpDir, FSTypeEXT4)
+	require.NoError(t, err, "init flakey")
+	defer flakey.Teardown()
+
+	transitions := []func(...FeatOpt) error{
+		flakey.AllowWrites,
+		flakey.DropWrites,
+		flakey.ErrorWrites,
+		func(opts ...FeatOpt) error {
+			return flakey.CorruptBIOByte(1, BIOWrite, 0, 0, opts...)
+		},
+	}
+
+	var (
+		wg      sync.WaitGroup
+		workers = 16
+		loops   = 10
+		errCh   = make(chan error, workers*loops+1)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < loops; j++ {
+				errCh <- transitions[(i+j)%len(transitions)]()
+			}
+		}(i)
+	}
+
+	// teardown races with transitions
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		time.Sleep(500 * time.Millisecond)
+		errCh <- flakey.Teardown()
+	}()
+
+	wg.Wait()
+	close(errCh)
+
+	var succeeded, tornDown int
+	for err := range errCh {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, ErrTornDown):
+			tornDown++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	assert.Equal(t, workers*loops+1, succeeded+tornDown)
+
+	// every reload before teardown is successful and recorded
+	history := flakey.History()
+	assert.Len(t, history, succeeded-1)
+	for _, tr := range history {
+		assert.NoError(t, tr.Err)
+	}
+
+	// device has been removed instead of staying suspended
+	_, err = os.Stat(flakey.DevicePath())
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestTransitionWithContext(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	flakey, err := InitFlakey("go-dmflakey", tmpDir, FSTypeEXT4)
+	require.NoError(t, err, "init flakey")
+	defer flakey.Teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.ErrorIs(t, flakey.DropWrites(WithContextFeatOpt(ctx)), context.Canceled)
+	assert.Equal(t, FaultSpec{UpInterval: defaultInterval}, flakey.Mode())
+	assert.Empty(t, flakey.History())
+
+	require.ErrorIs(t, flakey.Unstall(WithContextFeatOpt(ctx)), context.Canceled)
+	require.ErrorIs(t, flakey.Teardown(WithContextFeatOpt(ctx)), context.Canceled)
+
+	// aborted transition doesn't leave device suspended
+	status, err := flakey.Status()
+	require.NoError(t, err)
+	assert.False(t, status.Suspended)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, flakey.DropWrites(WithContextFeatOpt(ctx)))
+}
+
+func TestLockTransitionWithDoneContext(t *testing.T) {
+	f := &flakey{transitionMu: make(chan struct{}, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// done context always wins even if the lock is free
+	for i := 0; i < 100; i++ {
+		require.ErrorIs(t, f.lockTransition(ctx), context.Canceled)
+	}
+
+	require.NoError(t, f.lockTransition(context.Background()))
+	f.unlockTransition()
+}
+
+func TestHistoryKeepsLatestTransitions(t *testing.T) {
+	f := &flakey{}
+
+	total := maxHistory + 10
+	for i := 0; i < total; i++ {
+		f.record(Transition{Action: TransitionLoad, Spec: FaultSpec{UpInterval: time.Duration(i) * time.Second}})
+	}
+
+	history := f.History()
+	require.Len(t, history, maxHistory)
+	assert.Equal(t, time.Duration(total-maxHistory)*time.Second, history[0].Spec.UpInterval)
+	assert.Equal(t, time.Duration(total-1)*time.Second, f.Mode().UpInterval)
+}
+
+func TestModeAndHistoryAreCopied(t *testing.T) {
+	f := &flakey{}
+
+	spec := FaultSpec{
+		DownInterval: time.Minute,
+		Features:     []Feature{DropWritesFeature{}},
+		Ranges:       []SectorRange{{Start: 0, Length: 8}},
+		Excludes:     []SectorRange{{Start: 0, Length: 1}},
+	}
+	f.record(Transition{Action: TransitionLoad, Spec: spec})
+
+	// caller's spec, mode and history share nothing with recorded one
+	spec.Ranges[0].Length = 16
+
+	mode := f.Mode()
+	mode.Features[0] = ErrorWritesFeature{}
+	mode.Excludes[0].Length = 2
+
+	history := f.History()
+	history[0].Spec.Ranges[0].Start = 8
+
+	expected := FaultSpec{
+		DownInterval: time.Minute,
+		Features:     []Feature{DropWritesFeature{}},
+		Ranges:       []SectorRange{{Start: 0, Length: 8}},
+		Excludes:     []SectorRange{{Start: 0, Length: 1}},
+	}
+	assert.Equal(t, expected, f.Mode())
+	assert.Equal(t, expected, f.History()[0].Spec)
+}
+
+func TestStall(t *testing.T) {
+	flakey, root := initFlakey(t, FSTypeEXT4)
+
+	require.NoError(t, mount(root, flakey.DevicePath(), ""))
+
+	require.Error(t, flakey.Stall(0))
+	require.NoError(t, flakey.Stall(time.Minute))
+	assert.ErrorIs(t, flakey.Stall(time.Minute), ErrStalled)
+	assert.ErrorIs(t, flakey.DropWrites(), ErrStalled)
+
+	status, err := flakey.Status()
+	require.NoError(t, err)
+	assert.True(t, status.Suspended)
+
+	// fsync blocks until unstall
+	done := make(chan error, 1)
+	go func() {
+		done <- writeFile(filepath.Join(root, "f1"), []byte("hello"), 0600, true)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("fsync returns while device is stalled: %v", err)
+	case <-time.After(time.Second):
+	}
+
+	go func() {
+		assert.NoError(t, flakey.Unstall())
+	}()
+	require.NoError(t, <-done)
+
+	// no-op if device isn't stalled
+	require.NoError(t, flakey.Unstall())
+
+	// watchdog resumes the device
+	require.NoError(t, flakey.Stall(time.Second))
+	start := time.Now()
+	require.NoError(t, writeFile(filepath.Join(root, "f2"), []byte("hello"), 0600, true))
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+
+	require.NoError(t, flakey.DropWrites())
+
+	// teardown resumes the stalled device
+	require.NoError(t, unmount(root))
+	require.NoError(t, flakey.Stall(time.Minute))
+	require.NoError(t, flakey.Teardown())
+
+	var actions []TransitionAction
+	for _, tr := range flakey.History() {
+		require.NoError(t, tr.Err)
+		actions = append(actions, tr.Action)
+	}
+	assert.Equal(t, []TransitionAction{
+		TransitionStall, TransitionUnstall,
+		TransitionStall, TransitionUnstall,
+		TransitionLoad,
+		TransitionStall, TransitionUnstall,
+	}, actions)
+
+	// stall doesn't change mode
+	assert.Equal(t, []Feature{DropWritesFeature{}}, flakey.Mode().Features)
+}
+
+func TestUnplug(t *testing.T) {
+	flakey, root := initFlakey(t, FSTypeEXT4)
+
+	require.NoError(t, mount(root, flakey.DevicePath(), ""))
+
+	f1 := filepath.Join(root, "f1")
+	require.NoError(t, writeFile(f1, bytes.Repeat([]byte("A"), 4096), 0600, true))
+
+	// O_DIRECT bypasses page cache so that I/O always reaches the device.
+	f, err := os.OpenFile(f1, os.O_RDWR|unix.O_DIRECT, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := alignedBlock(t)
+
+	require.NoError(t, flakey.Replug(), "no-op if it's plugged")
+	require.NoError(t, flakey.DropWrites(WithIntervalFeatOpt(time.Hour)))
+	mode := flakey.Mode()
+
+	require.NoError(t, flakey.Unplug())
+	assert.ErrorIs(t, flakey.Unplug(), ErrUnplugged)
+	assert.ErrorIs(t, flakey.AllowWrites(), ErrUnplugged)
+	assert.ErrorIs(t, flakey.Stall(time.Minute), ErrUnplugged)
+
+	status, err := flakey.Status()
+	require.NoError(t, err)
+	require.Len(t, status.Targets, 1)
+	assert.Equal(t, "error", status.Targets[0].Type)
+
+	_, err = f.ReadAt(buf, 0)
+	assert.ErrorContains(t, err, "input/output error")
+
+	require.NoError(t, flakey.Replug())
+	assert.Equal(t, mode, flakey.Mode())
+
+	history := flakey.History()
+	require.GreaterOrEqual(t, len(history), 2)
+	assert.Equal(t, TransitionUnplug, history[len(history)-2].Action)
+	assert.Equal(t, TransitionReplug, history[len(history)-1].Action)
+	assert.Equal(t, mode, history[len(history)-1].Spec)
+
+	status, err = flakey.Status()
+	require.NoError(t, err)
+	require.Len(t, status.Targets, 1)
+	assert.Equal(t, "flakey", status.Targets[0].Type)
+
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("A"), len(buf)), buf)
+
+	// teardown removes unplugged device and it's safe to retry
+	require.NoError(t, f.Close())
+	require.NoError(t, flakey.Unplug())
+	require.NoError(t, unmount(root))
+	require.NoError(t, flakey.Teardown())
+	require.NoError(t, flakey.Teardown())
+}
+
+func TestDMBackends(t *testing.T) {
+	flakey, _ := initFlakey(t, FSTypeEXT4)
+
+	require.NoError(t, flakey.DropWrites(WithSectorRangesFeatOpt(SectorRange{Start: 1 << 21, Length: 1 << 21})))
+
+	expected, err := dmsetupBackend{}.status("go-dmflakey")
+	require.NoError(t, err)
+	require.Len(t, expected.Targets, 3)
+
+	status, err := dmIoctlBackend{}.status("go-dmflakey")
+	require.NoError(t, err)
+	assert.Equal(t, expected, status)
+
+	expectedVersion, err := dmsetupBackend{}.targetVersion("flakey")
+	require.NoError(t, err)
+
+	ver, err := dmIoctlBackend{}.targetVersion("flakey")
+	require.NoError(t, err)
+	assert.Equal(t, expectedVersion, ver)
+}
+
+func BenchmarkTransition(b *testing.B) {
+	control, err := os.OpenFile(dm.ControlDevice, os.O_RDWR, 0)
+	if err != nil {
+		b.Skipf("skip: device-mapper is unavailable: %v", err)
+	}
+	control.Close()
+
+	for _, bc := range []struct {
+		name    string
+		backend dmBackend
+	}{
+		{"ioctl", dmIoctlBackend{}},
+		{"dmsetup", dmsetupBackend{}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			if _, ok := bc.backend.(dmsetupBackend); ok {
+				if _, err := exec.LookPath("dmsetup"); err != nil {
+					b.Skipf("skip: %v", err)
+				}
+			}
+			defer useBackend(bc.backend)()
+
+			flakey, err := InitFlakey("go-dmflakey", b.TempDir(), FSTypeEXT4)
+			require.NoError(b, err, "init flakey")
+			defer flakey.Teardown()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				transition := flakey.AllowWrites
+				if i%2 == 0 {
+					transition = flakey.DropWrites
+				}
+				require.NoError(b, transition())
+			}
+		})
+	}
+}
+
+func TestInitFlakeyWithLoopConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	f, err := InitFlakey("go-dmflakey", tmpDir, FSTypeEXT4,
+		WithLoopConfigInitOpt(loop.Config{DirectIO: true, AutoClear: true}))
+	require.NoError(t, err, "init flakey")
+	defer f.Teardown()
+
+	loopDevice := f.(*flakey).loopDevice
+	assert.GreaterOrEqual(t, f.LoopAttachStats().Attempts, 1)
+
+	info, err := loop.GetInfo(loopDevice)
+	require.NoError(t, err)
+	assert.True(t, info.AutoClear)
+	assert.Equal(t, filepath.Join(tmpDir, "go-dmflakey.img"), info.BackingFile)
+
+	// autoclear detaches loop device after flakey device is removed
+	require.NoError(t, f.Teardown())
+
+	_, err = loop.GetInfo(loopDevice)
+	assert.True(t, errors.Is(err, unix.ENXIO))
+}
+
+func TestBlockSize(t *testing.T) {
+	for _, layout := range []struct {
+		name              string
+		logical, physical int
+	}{
+		{name: "4Kn", logical: 4096, physical: 4096},
+		{name: "512e", logical: 512, physical: 4096},
+	} {
+		for _, fsType := range []FSType{FSTypeEXT4, FSTypeXFS} {
+			layout, fsType := layout, fsType
+
+			t.Run(layout.name+"/"+string(fsType), func(t *testing.T) {
+				if _, err := exec.LookPath("mkfs." + string(fsType)); err != nil {
+					t.Skipf("skip: %v", err)
+				}
+
+				testBlockSize(t, fsType, layout.logical, layout.physical)
+			})
+		}
+	}
+}
+
+func testBlockSize(t *testing.T, fsType FSType, logical, physical int) {
+	if logical < physical {
+		// dm-ebs might be built as module which isn't loaded yet
+		_ = exec.Command("modprobe", "dm-ebs").Run()
+		if _, err := getBackend().targetVersion("ebs"); err != nil {
+			t.Skipf("skip 512e without dm-ebs: %v", err)
+		}
+	}
+
+	flakey, root := initFlakey(t, fsType, WithBlockSizeInitOpt(logical, physical))
+	assert.Equal(t, logical, flakey.LogicalBlockSize())
+	assert.Equal(t, physical, flakey.PhysicalBlockSize())
+
+	l, p, err := getBlkSectorSizes(flakey.DevicePath())
+	require.NoError(t, err)
+	assert.Equal(t, logical, l)
+	assert.Equal(t, physical, p)
+
+	// filesystem is created with the logical block size
+	require.NoError(t, mount(root, flakey.DevicePath(), ""))
+	require.NoError(t, writeFile(filepath.Join(root, "f1"), []byte("A"), 0600, true))
+	require.NoError(t, unmount(root))
+
+	// O_DIRECT must be aligned to logical block size
+	dev, err := os.OpenFile(flakey.DevicePath(), os.O_RDWR|unix.O_DIRECT, 0)
+	require.NoError(t, err)
+	defer dev.Close()
+
+	buf := alignedBlock(t)
+
+	_, err = dev.ReadAt(buf, int64(logical))
+	assert.NoError(t, err)
+
+	if logical > SectorSize {
+		_, err = dev.ReadAt(buf, SectorSize)
+		assert.ErrorIs(t, err, unix.EINVAL)
+	}
+
+	// sector range must be aligned to logical block size
+	sectors := int64(logical / SectorSize)
+	if sectors > 1 {
+		err = flakey.ErrorWrites(WithSectorRangesFeatOpt(SectorRange{Start: 1, Length: sectors}))
+		assert.ErrorContains(t, err, fmt.Sprintf("isn't aligned to logical block size %d", logical))
+	}
+
+	faulty := SectorRange{Start: sectors, Length: sectors}
+	require.NoError(t, flakey.ErrorWrites(WithSectorRangesFeatOpt(faulty)))
+
+	_, err = dev.WriteAt(buf[:logical], faulty.Start*SectorSize)
+	assert.ErrorContains(t, err, "input/output error")
+
+	_, err = dev.WriteAt(buf[:logical], faulty.End()*SectorSize)
+	assert.NoError(t, err)
+}
+
+func TestInvalidBlockSize(t *testing.T) {
+	for _, tc := range []struct {
+		logical, physical int
+		errMsg            string
+	}{
+		{logical: 0, physical: 4096, errMsg: "invalid logical block size 0"},
+		{logical: 256, errMsg: "invalid logical block size 256"},
+		{logical: 3072, errMsg: "invalid logical block size 3072"},
+		{logical: 2 * os.Getpagesize(), errMsg: "invalid logical block size"},
+		{logical: 4096, physical: 512, errMsg: "invalid physical block size 512"},
+		{logical: 512, physical: 3072, errMsg: "invalid physical block size 3072"},
+		{logical: 512, physical: 2 * os.Getpagesize(), errMsg: "invalid physical block size"},
+	} {
+		_, err := InitFlakey("go-dmflakey", t.TempDir(), FSTypeEXT4,
+			WithBlockSizeInitOpt(tc.logical, tc.physical))
+		assert.ErrorContains(t, err, tc.errMsg, "logical %d, physical %d", tc.logical, tc.physical)
+	}
+}
+
+func TestReloadError(t *testing.T) {
+	err := fmt.Errorf("failed to reload: %w", &ReloadError{
+		Device: "go-dmflakey",
+		Stage:  ReloadSuspend,
+		Err:    fmt.Errorf("%w: %w", ErrSuspendTimeout, context.DeadlineExceeded),
+	})
+	assert.ErrorIs(t, err, ErrSuspendTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var rerr *ReloadError
+	require.ErrorAs(t, err, &rerr)
+	assert.Equal(t, ReloadSuspend, rerr.Stage)
+	assert.Contains(t, err.Error(), "failed to suspend flakey device go-dmflakey: suspend timed out")
+}
+
+func TestStatus(t *testing.T) {
+	flakey, _ := initFlakey(t, FSTypeEXT4)
+
+	status, err := flakey.Status()
+	require.NoError(t, err)
+	assert.Equal(t, "go-dmflakey", status.Name)
+	assert.False(t, status.Suspended)
+	assert.True(t, status.LiveTable)
+	assert.False(t, status.InactiveTable)
+	require.Len(t, status.Targets, 1)
+	assert.Equal(t, "flakey", status.Targets[0].Type)
+	assert.Equal(t, defaultInterval, status.Targets[0].UpInterval)
+
+	faulty := SectorRange{Start: 1 << 21, Length: 1 << 21}
+	require.NoError(t, flakey.DropWrites(WithSectorRangesFeatOpt(faulty)))
+
+	status, err = flakey.Status()
+	require.NoError(t, err)
+	require.Len(t, status.Targets, 3)
+	assert.Equal(t, "linear", status.Targets[0].Type)
+	assert.Equal(t, TargetStatus{
+		Start:        faulty.Start,
+		Length:       faulty.Length,
+		Type:         "flakey",
+		Device:       status.Targets[0].Device,
+		Offset:       faulty.Start,
+		DownInterval: defaultInterval,
+		Features:     []Feature{DropWritesFeature{}},
+		Params:       status.Targets[1].Params,
+	}, status.Targets[1])
+	assert.Equal(t, "linear", status.Targets[2].Type)
+}
+
+func initFlakey(t *testing.T, fsType FSType, opts ...InitOpt) (_ Flakey, root string) {
 	tmpDir := t.TempDir()
 
 	target := filepath.Join(tmpDir, "root")
 	require.NoError(t, os.MkdirAll(target, 0600))
 
-	flakey, err := InitFlakey("go-dmflakey", tmpDir, FSTypeEXT4)
+	flakey, err := InitFlakey("go-dmflakey", tmpDir, fsType, opts...)
 	require.NoError(t, err, "init flakey")
 
 	t.Cleanup(func() {
@@ -125,6 +1115,30 @@ func initFlakey(t *testing.T, fsType FSType) (_ Flakey, root string) {
 	return flakey, target
 }
 
+// useBackend switches the device-mapper backend and returns the function to
+// restore it.
+func useBackend(b dmBackend) func() {
+	prev := getBackend()
+	backend = b
+	runningVersionsOnce = sync.Once{}
+	return func() {
+		backend = prev
+		runningVersionsOnce = sync.Once{}
+	}
+}
+
+// alignedBlock returns 4 KiB page-aligned buffer for O_DIRECT I/O.
+func alignedBlock(t *testing.T) []byte {
+	buf, err := unix.Mmap(-1, 0, 4096,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		assert.NoError(t, unix.Munmap(buf))
+	})
+	return buf
+}
+
 func writeFile(name string, data []byte, perm os.FileMode, sync bool) error {
 	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
@@ -0,0 +1,106 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fuweid/go-dmflakey/dm"
+)
+
+// dmIoctlBackend manages device-mapper devices by dm package without forking
+// dmsetup.
+type dmIoctlBackend struct{}
+
+// create creates the device with table and activates it.
+func (dmIoctlBackend) create(name, table string) error {
+	t, err := dm.ParseTable(table)
+	if err != nil {
+		return err
+	}
+	return dm.Create(name, t)
+}
+
+// load loads the table into inactive slot.
+func (dmIoctlBackend) load(name, table string) error {
+	t, err := dm.ParseTable(table)
+	if err != nil {
+		return err
+	}
+	return dm.Load(name, t)
+}
+
+// suspend suspends the device.
+func (dmIoctlBackend) suspend(ctx context.Context, name string, lockfs bool) error {
+	var opts []dm.SuspendOpt
+	if !lockfs {
+		opts = append(opts, dm.WithNoLockFSSuspendOpt())
+	}
+	return dm.Suspend(ctx, name, opts...)
+}
+
+// resume resumes the device.
+func (dmIoctlBackend) resume(name string) error {
+	return dm.Resume(name)
+}
+
+// remove removes the device.
+func (dmIoctlBackend) remove(name string) error {
+	return dm.Remove(name)
+}
+
+// status returns the device info and tables.
+func (dmIoctlBackend) status(name string) (*Status, error) {
+	info, err := dm.Info(name)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{
+		Name:          info.Name,
+		Suspended:     info.Suspended,
+		LiveTable:     info.LiveTable,
+		InactiveTable: info.InactiveTable,
+		OpenCount:     info.OpenCount,
+		EventNumber:   info.EventNumber,
+		Major:         info.Major,
+		Minor:         info.Minor,
+	}
+
+	if status.LiveTable {
+		if status.Targets, err = getDMIoctlTable(name, false); err != nil {
+			return nil, err
+		}
+	}
+	if status.InactiveTable {
+		if status.InactiveTargets, err = getDMIoctlTable(name, true); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// targetVersion returns the version of target registered in kernel.
+func (dmIoctlBackend) targetVersion(target string) (version, error) {
+	versions, err := dm.Versions()
+	if err != nil {
+		return version{}, err
+	}
+
+	for _, v := range versions {
+		if v.Name == target {
+			return version{int(v.Version[0]), int(v.Version[1]), int(v.Version[2])}, nil
+		}
+	}
+	return version{}, fmt.Errorf("%s target is not registered", target)
+}
+
+// getDMIoctlTable returns the live or inactive table of device.
+func getDMIoctlTable(name string, inactive bool) ([]TargetStatus, error) {
+	table, err := dm.GetTable(name, inactive)
+	if err != nil {
+		return nil, err
+	}
+	return parseTable(table.String())
+}
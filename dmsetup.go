@@ -3,78 +3,137 @@
 package dmflakey
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
-	"time"
+	"strings"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-// newFlakeyDevice creates flakey device.
+// dmsetupBackend manages device-mapper devices by dmsetup command. It's the
+// fallback if the ioctl interface isn't available.
 //
-// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-flakey.html
-func newFlakeyDevice(flakeyDevice, loopDevice string, interval time.Duration) error {
-	loopSize, err := getBlkSize(loopDevice)
-	if err != nil {
-		return fmt.Errorf("failed to get loop device %s size: %w", loopDevice, err)
+// REF: https://man7.org/linux/man-pages/man8/dmsetup.8.html
+type dmsetupBackend struct{}
+
+// udevControl is the control socket of running udev daemon.
+const udevControl = "/run/udev/control"
+
+// udevArgs returns the dmsetup arguments about udev. If udev isn't running,
+// like in container, dmsetup creates the device node by itself without
+// waiting for udev cookie which is never completed. Otherwise, dmsetup
+// verifies the node created by udev and fixes it if any.
+func udevArgs() []string {
+	if _, err := os.Stat(udevControl); err != nil {
+		return []string{"--noudevsync"}
 	}
+	return []string{"--verifyudev"}
+}
 
-	// The flakey device will be available in interval.Seconds().
-	table := fmt.Sprintf("0 %d flakey %s 0 %d 0",
-		loopSize, loopDevice, int(interval.Seconds()))
+// create creates the device with table and activates it.
+func (dmsetupBackend) create(name, table string) error {
+	// NOTE: --table only accepts one-line table, so pass it by stdin.
+	cmd := exec.Command("dmsetup", append(udevArgs(), "create", name)...)
+	cmd.Stdin = strings.NewReader(table)
 
-	args := []string{"create", flakeyDevice, "--table", table}
+	return runDMSetup(cmd)
+}
 
-	output, err := exec.Command("dmsetup", args...).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to create flakey device %s with table %s (out: %s): %w",
-			flakeyDevice, table, string(output), err)
-	}
-	return nil
+// load loads the table into inactive slot.
+func (dmsetupBackend) load(name, table string) error {
+	// NOTE: --table only accepts one-line table, so pass it by stdin.
+	cmd := exec.Command("dmsetup", "load", name)
+	cmd.Stdin = strings.NewReader(table)
+
+	return runDMSetup(cmd)
 }
 
-// reloadFlakeyDevice reloads the flakey device with feature table.
-func reloadFlakeyDevice(flakeyDevice string, syncFS bool, table string) (retErr error) {
-	args := []string{"suspend", "--nolockfs", flakeyDevice}
-	if syncFS {
-		args[1] = flakeyDevice
-		args = args[:len(args)-1]
+// suspend suspends the device. The dmsetup is killed if the context is done.
+func (dmsetupBackend) suspend(ctx context.Context, name string, lockfs bool) error {
+	args := []string{"suspend"}
+	if !lockfs {
+		args = append(args, "--nolockfs")
 	}
+	args = append(args, name)
+
+	return runDMSetup(exec.CommandContext(ctx, "dmsetup", args...))
+}
+
+// resume resumes the device.
+func (dmsetupBackend) resume(name string) error {
+	return runDMSetup(exec.Command("dmsetup", append(udevArgs(), "resume", name)...))
+}
+
+// remove removes the device.
+func (dmsetupBackend) remove(name string) error {
+	return runDMSetup(exec.Command("dmsetup", append(udevArgs(), "remove", name)...))
+}
 
-	output, err := exec.Command("dmsetup", args...).CombinedOutput()
+// status returns the device info and tables.
+func (dmsetupBackend) status(name string) (*Status, error) {
+	output, err := exec.Command("dmsetup", "info", name).CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to suspend flakey device %s (out: %s): %w",
-			flakeyDevice, string(output), err)
+		return nil, fmt.Errorf("failed to get info (out: %s): %w", string(output), err)
+	}
+
+	status := &Status{}
+	if err := parseDeviceInfo(string(output), status); err != nil {
+		return nil, err
 	}
 
-	defer func() {
-		output, derr := exec.Command("dmsetup", "resume", flakeyDevice).CombinedOutput()
-		if derr != nil {
-			derr = fmt.Errorf("failed to resume flakey device %s (out: %s): %w",
-				flakeyDevice, string(output), derr)
+	if status.LiveTable {
+		if status.Targets, err = getDMSetupTable(name, false); err != nil {
+			return nil, err
 		}
+	}
+	if status.InactiveTable {
+		if status.InactiveTargets, err = getDMSetupTable(name, true); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// targetVersion returns the version of target registered in kernel.
+func (dmsetupBackend) targetVersion(target string) (version, error) {
+	output, err := exec.Command("dmsetup", "targets").CombinedOutput()
+	if err != nil {
+		return version{}, fmt.Errorf("failed to list device-mapper targets (out: %s): %w",
+			string(output), err)
+	}
 
-		if retErr == nil {
-			retErr = derr
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != target {
+			continue
 		}
-	}()
+		return parseVersion(fields[1])
+	}
+	return version{}, fmt.Errorf("%s target is not registered (out: %s)", target, string(output))
+}
+
+// getDMSetupTable returns the live or inactive table of device.
+func getDMSetupTable(name string, inactive bool) ([]TargetStatus, error) {
+	args := []string{"table", name}
+	if inactive {
+		args = append(args, "--inactive")
+	}
 
-	output, err = exec.Command("dmsetup", "load", flakeyDevice, "--table", table).CombinedOutput()
+	output, err := exec.Command("dmsetup", args...).Output()
 	if err != nil {
-		return fmt.Errorf("failed to reload flakey device %s with table (%s) (out: %s): %w",
-			flakeyDevice, table, string(output), err)
+		return nil, fmt.Errorf("failed to get table (args: %v): %w", args, err)
 	}
-	return nil
+	return parseTable(string(output))
 }
 
-// removeFlakeyDevice removes flakey device.
-func deleteFlakeyDevice(flakeyDevice string) error {
-	output, err := exec.Command("dmsetup", "remove", flakeyDevice).CombinedOutput()
+// runDMSetup runs dmsetup command with output in error.
+func runDMSetup(cmd *exec.Cmd) error {
+	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to remove flakey device %s (out: %s): %w",
-			flakeyDevice, string(output), err)
+		return fmt.Errorf("%w (args: %v) (out: %s)", err, cmd.Args[1:], string(output))
 	}
 	return nil
 }
@@ -103,3 +162,25 @@ func getBlkSize(device string) (int64, error) {
 	size, err := getBlkSize64(device)
 	return size / 512, err
 }
+
+// getBlkSectorSizes gets logical (BLKSSZGET) and physical (BLKPBSZGET) block
+// size in bytes.
+//
+// REF: https://man7.org/linux/man-pages/man8/blockdev.8.html
+func getBlkSectorSizes(device string) (logical, physical int, _ error) {
+	deviceFd, err := os.Open(device)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open device %s: %w", device, err)
+	}
+	defer deviceFd.Close()
+
+	if logical, err = unix.IoctlGetInt(int(deviceFd.Fd()), unix.BLKSSZGET); err != nil {
+		return 0, 0, fmt.Errorf("failed to get logical block size: %w", err)
+	}
+
+	pbsz, err := unix.IoctlGetUint32(int(deviceFd.Fd()), unix.BLKPBSZGET)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get physical block size: %w", err)
+	}
+	return logical, int(pbsz), nil
+}
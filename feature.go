@@ -0,0 +1,361 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BIODirection represents the direction of bio.
+type BIODirection string
+
+// Supported bio directions.
+const (
+	BIORead  BIODirection = "r"
+	BIOWrite BIODirection = "w"
+)
+
+// BIOFlag represents the REQ_* bits of bio's bi_opf.
+//
+// The values follow enum req_flag_bits in include/linux/blk_types.h, but the
+// bits have been renumbered across kernel releases. Check blk_types.h of the
+// running kernel and use BIOFlag(1 << bit) directly if they differ.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-flakey.html
+type BIOFlag uint32
+
+// Supported bio flags.
+const (
+	// BIOFlagFailFastDev means no driver retries of device errors.
+	BIOFlagFailFastDev BIOFlag = 1 << (iota + 8)
+	// BIOFlagFailFastTransport means no driver retries of transport errors.
+	BIOFlagFailFastTransport
+	// BIOFlagFailFastDriver means no driver retries of driver errors.
+	BIOFlagFailFastDriver
+	// BIOFlagSync means request is sync (sync write or read).
+	BIOFlagSync
+	// BIOFlagMeta means metadata io request.
+	BIOFlagMeta
+	// BIOFlagPrio means boost priority.
+	BIOFlagPrio
+	// BIOFlagNoMerge means don't touch this for merging.
+	BIOFlagNoMerge
+	// BIOFlagIdle means anticipate more IO after this one.
+	BIOFlagIdle
+	// BIOFlagIntegrity means I/O includes block integrity payload.
+	BIOFlagIntegrity
+	// BIOFlagFUA means forced unit access.
+	BIOFlagFUA
+	// BIOFlagPreflush means request for cache flush.
+	BIOFlagPreflush
+	// BIOFlagRahead means read ahead, can fail anytime.
+	BIOFlagRahead
+	// BIOFlagBackground means background IO.
+	BIOFlagBackground
+)
+
+// MaxProbability is the denominator of random corruption probability.
+const MaxProbability = 1000000000
+
+// Feature is the dm-flakey feature which takes effect in down interval.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-flakey.html
+type Feature interface {
+	// Name returns the feature name in table.
+	Name() string
+
+	// Args returns the feature arguments in table.
+	Args() []string
+
+	// validate validates the feature arguments.
+	validate() error
+}
+
+// DropWritesFeature drops all write I/O silently.
+type DropWritesFeature struct{}
+
+// Name returns drop_writes.
+func (DropWritesFeature) Name() string { return "drop_writes" }
+
+// Args returns nothing.
+func (DropWritesFeature) Args() []string { return nil }
+
+func (DropWritesFeature) validate() error { return nil }
+
+// ErrorWritesFeature fails all write I/O with an error signalled.
+type ErrorWritesFeature struct{}
+
+// Name returns error_writes.
+func (ErrorWritesFeature) Name() string { return "error_writes" }
+
+// Args returns nothing.
+func (ErrorWritesFeature) Args() []string { return nil }
+
+func (ErrorWritesFeature) validate() error { return nil }
+
+// ErrorReadsFeature fails all read I/O with an error signalled.
+type ErrorReadsFeature struct{}
+
+// Name returns error_reads.
+func (ErrorReadsFeature) Name() string { return "error_reads" }
+
+// Args returns nothing.
+func (ErrorReadsFeature) Args() []string { return nil }
+
+func (ErrorReadsFeature) validate() error { return nil }
+
+// CorruptBIOByteFeature replaces the Nth byte (starting from 1) of every bio
+// in the Direction with Value. Only the bio whose flags contain all the bits
+// of Flags is corrupted. Zero Flags matches all the bios.
+type CorruptBIOByteFeature struct {
+	Nth       int
+	Direction BIODirection
+	Value     uint8
+	Flags     BIOFlag
+}
+
+// Name returns corrupt_bio_byte.
+func (CorruptBIOByteFeature) Name() string { return "corrupt_bio_byte" }
+
+// Args returns <Nth_byte> <direction> <value> <flags>.
+func (feat CorruptBIOByteFeature) Args() []string {
+	return []string{
+		strconv.Itoa(feat.Nth),
+		string(feat.Direction),
+		strconv.FormatUint(uint64(feat.Value), 10),
+		strconv.FormatUint(uint64(feat.Flags), 10),
+	}
+}
+
+func (feat CorruptBIOByteFeature) validate() error {
+	if feat.Nth < 1 {
+		return fmt.Errorf("invalid nth byte %d: must start from 1", feat.Nth)
+	}
+	return validateBIODirection(feat.Direction)
+}
+
+// RandomReadCorruptFeature replaces random byte in a read bio with a random
+// value. The Probability is out of MaxProbability.
+type RandomReadCorruptFeature struct {
+	Probability int
+}
+
+// Name returns random_read_corrupt.
+func (RandomReadCorruptFeature) Name() string { return "random_read_corrupt" }
+
+// Args returns <probability>.
+func (feat RandomReadCorruptFeature) Args() []string {
+	return []string{strconv.Itoa(feat.Probability)}
+}
+
+func (feat RandomReadCorruptFeature) validate() error {
+	return validateProbability(feat.Name(), feat.Probability)
+}
+
+// RandomWriteCorruptFeature replaces random byte in a write bio with a random
+// value. The Probability is out of MaxProbability.
+type RandomWriteCorruptFeature struct {
+	Probability int
+}
+
+// Name returns random_write_corrupt.
+func (RandomWriteCorruptFeature) Name() string { return "random_write_corrupt" }
+
+// Args returns <probability>.
+func (feat RandomWriteCorruptFeature) Args() []string {
+	return []string{strconv.Itoa(feat.Probability)}
+}
+
+func (feat RandomWriteCorruptFeature) validate() error {
+	return validateProbability(feat.Name(), feat.Probability)
+}
+
+// FaultSpec describes the behaviour of flakey device.
+//
+// The device is available for UpInterval and then the Features take effect
+// for DownInterval, over and over. If one of intervals is zero, the device
+// stays in the other state. If there is no feature, all the read and write
+// I/O is failed in down interval.
+//
+// If Ranges is not empty, only these sector ranges misbehave and the rest of
+// device stays healthy. Excludes are always healthy, even if they overlap with
+// Ranges.
+//
+// dm-flakey only accepts intervals in whole seconds.
+type FaultSpec struct {
+	// UpInterval is how long the device is available in each cycle.
+	UpInterval time.Duration
+	// DownInterval is how long the features take effect in each cycle.
+	DownInterval time.Duration
+	// Features are applied in down interval.
+	Features []Feature
+	// Ranges limits the fault to the sector ranges. Empty means the whole
+	// device.
+	Ranges []SectorRange
+	// Excludes are the sector ranges which are always healthy.
+	Excludes []SectorRange
+}
+
+// String returns the spec in dm-flakey table format.
+func (spec FaultSpec) String() string {
+	args, err := spec.args()
+	if err != nil {
+		return fmt.Sprintf("invalid spec: %v", err)
+	}
+	return strings.Join(args, " ")
+}
+
+// clone returns the deep copy of spec, so that the caller can't change the
+// slices of recorded spec.
+func (spec FaultSpec) clone() FaultSpec {
+	spec.Features = append([]Feature(nil), spec.Features...)
+	spec.Ranges = append([]SectorRange(nil), spec.Ranges...)
+	spec.Excludes = append([]SectorRange(nil), spec.Excludes...)
+	return spec
+}
+
+// describe returns the spec in human readable format, like
+// "down 2m0s: drop_writes on [0, 8)".
+func (spec FaultSpec) describe() string {
+	var res string
+	switch {
+	case spec.UpInterval > 0 && spec.DownInterval > 0:
+		res = fmt.Sprintf("up %v down %v", spec.UpInterval, spec.DownInterval)
+	case spec.DownInterval > 0:
+		res = fmt.Sprintf("down %v", spec.DownInterval)
+	default:
+		res = fmt.Sprintf("up %v", spec.UpInterval)
+	}
+
+	if spec.DownInterval > 0 {
+		feats := make([]string, 0, len(spec.Features))
+		for _, feat := range spec.Features {
+			feats = append(feats, strings.Join(append([]string{feat.Name()}, feat.Args()...), " "))
+		}
+		if len(feats) == 0 {
+			feats = append(feats, "all I/O fails")
+		}
+		res += ": " + strings.Join(feats, ", ")
+	}
+
+	if len(spec.Ranges) > 0 {
+		res += fmt.Sprintf(" on %v", spec.Ranges)
+	}
+	if len(spec.Excludes) > 0 {
+		res += fmt.Sprintf(" excluding %v", spec.Excludes)
+	}
+	return res
+}
+
+// args returns <up interval> <down interval> [<num_features> [<feature arguments>]].
+func (spec FaultSpec) args() ([]string, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		strconv.Itoa(int(spec.UpInterval.Seconds())),
+		strconv.Itoa(int(spec.DownInterval.Seconds())),
+	}
+	if len(spec.Features) == 0 {
+		return args, nil
+	}
+
+	featArgs := spec.featureArgs()
+	args = append(args, strconv.Itoa(len(featArgs)))
+	return append(args, featArgs...), nil
+}
+
+// featureArgs returns the feature names followed by their arguments.
+func (spec FaultSpec) featureArgs() []string {
+	var featArgs []string
+	for _, feat := range spec.Features {
+		featArgs = append(featArgs, feat.Name())
+		featArgs = append(featArgs, feat.Args()...)
+	}
+	return featArgs
+}
+
+// validate validates intervals, sector ranges and features, including the
+// conflicts rejected by dm-flakey. The sector ranges are checked against the
+// device size when building table.
+func (spec FaultSpec) validate() error {
+	if spec.UpInterval < 0 || spec.DownInterval < 0 {
+		return fmt.Errorf("invalid negative interval (up: %v, down: %v)",
+			spec.UpInterval, spec.DownInterval)
+	}
+
+	if int(spec.UpInterval.Seconds())+int(spec.DownInterval.Seconds()) == 0 {
+		return fmt.Errorf("total (up + down) interval is zero (up: %v, down: %v)",
+			spec.UpInterval, spec.DownInterval)
+	}
+
+	for _, r := range spec.Ranges {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	for _, r := range spec.Excludes {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("invalid excluded sector range: %w", err)
+		}
+	}
+
+	var (
+		seen         = make(map[string]bool, len(spec.Features))
+		corruptWrite bool
+	)
+	for _, feat := range spec.Features {
+		if feat == nil {
+			return fmt.Errorf("invalid nil feature")
+		}
+
+		name := feat.Name()
+		if seen[name] {
+			return fmt.Errorf("feature %s duplicated", name)
+		}
+		seen[name] = true
+
+		if err := feat.validate(); err != nil {
+			return err
+		}
+
+		switch feat := feat.(type) {
+		case CorruptBIOByteFeature:
+			corruptWrite = corruptWrite || feat.Direction == BIOWrite
+		case RandomWriteCorruptFeature:
+			corruptWrite = true
+		}
+	}
+
+	dropWrites, errorWrites := seen[DropWritesFeature{}.Name()], seen[ErrorWritesFeature{}.Name()]
+	if dropWrites && errorWrites {
+		return fmt.Errorf("feature drop_writes conflicts with feature error_writes")
+	}
+	if (dropWrites || errorWrites) && corruptWrite {
+		return fmt.Errorf("feature drop_writes or error_writes conflicts with write corruption")
+	}
+	return nil
+}
+
+// validateBIODirection validates the bio direction input.
+func validateBIODirection(dir BIODirection) error {
+	switch dir {
+	case BIORead, BIOWrite:
+		return nil
+	default:
+		return fmt.Errorf("unsupported bio direction %q", dir)
+	}
+}
+
+// validateProbability validates the probability input.
+func validateProbability(feature string, probability int) error {
+	if probability < 0 || probability > MaxProbability {
+		return fmt.Errorf("invalid %s probability %d: must be in [0, %d]",
+			feature, probability, MaxProbability)
+	}
+	return nil
+}
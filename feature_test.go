@@ -0,0 +1,173 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultSpecString(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		spec     FaultSpec
+		expected string
+		hasErr   bool
+	}{
+		{
+			name:     "up only",
+			spec:     FaultSpec{UpInterval: time.Minute},
+			expected: "60 0",
+		},
+		{
+			name:     "all I/O fails in down interval",
+			spec:     FaultSpec{UpInterval: 10 * time.Second, DownInterval: 5 * time.Second},
+			expected: "10 5",
+		},
+		{
+			name: "combined features",
+			spec: FaultSpec{
+				DownInterval: time.Minute,
+				Features: []Feature{
+					DropWritesFeature{},
+					RandomReadCorruptFeature{Probability: 1000},
+					CorruptBIOByteFeature{Nth: 32, Direction: BIORead, Value: 1, Flags: BIOFlagMeta | BIOFlagSync},
+				},
+			},
+			expected: "0 60 8 drop_writes random_read_corrupt 1000 corrupt_bio_byte 32 r 1 6144",
+		},
+		{
+			name: "duplicated",
+			spec: FaultSpec{
+				DownInterval: time.Minute,
+				Features:     []Feature{ErrorReadsFeature{}, ErrorReadsFeature{}},
+			},
+			hasErr: true,
+		},
+		{
+			name: "drop_writes and error_writes",
+			spec: FaultSpec{
+				DownInterval: time.Minute,
+				Features:     []Feature{DropWritesFeature{}, ErrorWritesFeature{}},
+			},
+			hasErr: true,
+		},
+		{
+			name: "error_writes and write corruption",
+			spec: FaultSpec{
+				DownInterval: time.Minute,
+				Features:     []Feature{ErrorWritesFeature{}, RandomWriteCorruptFeature{Probability: 1}},
+			},
+			hasErr: true,
+		},
+		{
+			name: "invalid nth",
+			spec: FaultSpec{
+				DownInterval: time.Minute,
+				Features:     []Feature{CorruptBIOByteFeature{Direction: BIORead}},
+			},
+			hasErr: true,
+		},
+		{
+			name: "invalid direction",
+			spec: FaultSpec{
+				DownInterval: time.Minute,
+				Features:     []Feature{CorruptBIOByteFeature{Nth: 1, Direction: "x"}},
+			},
+			hasErr: true,
+		},
+		{
+			name: "invalid probability",
+			spec: FaultSpec{
+				DownInterval: time.Minute,
+				Features:     []Feature{RandomWriteCorruptFeature{Probability: MaxProbability + 1}},
+			},
+			hasErr: true,
+		},
+		{
+			name: "invalid range",
+			spec: FaultSpec{
+				DownInterval: time.Minute,
+				Ranges:       []SectorRange{{Start: -1, Length: 8}},
+			},
+			hasErr: true,
+		},
+		{
+			name: "invalid exclude",
+			spec: FaultSpec{
+				DownInterval: time.Minute,
+				Excludes:     []SectorRange{{Start: 8, Length: 0}},
+			},
+			hasErr: true,
+		},
+		{
+			name:   "zero intervals",
+			spec:   FaultSpec{Features: []Feature{ErrorReadsFeature{}}},
+			hasErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args, err := tc.spec.args()
+			if tc.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, strings.Join(args, " "))
+			assert.Equal(t, tc.expected, tc.spec.String())
+		})
+	}
+}
+
+func TestTransitionString(t *testing.T) {
+	at := time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		transition Transition
+		expected   string
+	}{
+		{
+			transition: Transition{Action: TransitionLoad, Time: at, Duration: time.Millisecond, Spec: FaultSpec{UpInterval: time.Minute}},
+			expected:   "2023-11-14T00:00:00Z (+1ms) load up 1m0s",
+		},
+		{
+			transition: Transition{
+				Action:   TransitionLoad,
+				Time:     at,
+				Duration: time.Millisecond,
+				Spec: FaultSpec{
+					DownInterval: time.Minute,
+					Features:     []Feature{DropWritesFeature{}, RandomReadCorruptFeature{Probability: 10}},
+					Ranges:       []SectorRange{{Start: 0, Length: 8}},
+				},
+			},
+			expected: "2023-11-14T00:00:00Z (+1ms) load down 1m0s: drop_writes, random_read_corrupt 10 on [[0, 8)]",
+		},
+		{
+			transition: Transition{
+				Action:   TransitionLoad,
+				Time:     at,
+				Duration: time.Second,
+				Spec:     FaultSpec{UpInterval: time.Minute, DownInterval: time.Second},
+				Err:      errors.New("boom"),
+			},
+			expected: "2023-11-14T00:00:00Z (+1s) load up 1m0s down 1s: all I/O fails failed: boom",
+		},
+		{
+			transition: Transition{
+				Action:   TransitionStall,
+				Time:     at,
+				Duration: time.Millisecond,
+				Spec:     FaultSpec{UpInterval: time.Minute},
+			},
+			expected: "2023-11-14T00:00:00Z (+1ms) stall up 1m0s",
+		},
+	} {
+		assert.Equal(t, tc.expected, tc.transition.String())
+	}
+}
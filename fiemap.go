@@ -0,0 +1,147 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileExtents is the physical layout of file on the flakey device.
+type FileExtents struct {
+	// Ranges are the sector ranges holding the file's data on the flakey
+	// device. They can be used as FaultSpec.Ranges.
+	Ranges []SectorRange
+	// Delalloc is true if part of the file hasn't been allocated yet
+	// because of delayed allocation, or its location is unknown. The extents
+	// could change after writeback. Call fsync before mapping to get stable
+	// extents.
+	Delalloc bool
+	// Inline is true if part of the file is stored with metadata, like
+	// ext4 inline data. It's not included in Ranges.
+	Inline bool
+}
+
+// MapFile resolves the physical extents of file on the mounted flakey device
+// by FS_IOC_FIEMAP.
+//
+// REF: https://docs.kernel.org/filesystems/fiemap.html
+func MapFile(f Flakey, path string) (*FileExtents, error) {
+	if err := ensureFileOnDevice(path, f.DevicePath()); err != nil {
+		return nil, err
+	}
+	return getFileExtents(path)
+}
+
+// getFileExtents returns the file's extents by FS_IOC_FIEMAP.
+func getFileExtents(path string) (*FileExtents, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var (
+		res   FileExtents
+		start uint64
+		buf   fiemapBuffer
+	)
+	for {
+		buf = fiemapBuffer{}
+		buf.hdr.start = start
+		buf.hdr.length = ^uint64(0) - start
+		buf.hdr.extentCount = fiemapExtentCount
+
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&buf))); errno != 0 {
+			return nil, fmt.Errorf("failed to get extents of %s: %w", path, errno)
+		}
+
+		if buf.hdr.mappedExtents == 0 {
+			break
+		}
+
+		var last bool
+		for _, ext := range buf.extents[:buf.hdr.mappedExtents] {
+			switch {
+			case ext.flags&(fiemapExtentDelalloc|fiemapExtentUnknown) != 0:
+				res.Delalloc = true
+			case ext.flags&fiemapExtentDataInline != 0:
+				res.Inline = true
+			default:
+				// round outward if the extent isn't block-aligned
+				first := int64(ext.physical / SectorSize)
+				end := int64((ext.physical + ext.length + SectorSize - 1) / SectorSize)
+				res.Ranges = append(res.Ranges, SectorRange{Start: first, Length: end - first})
+			}
+
+			start = ext.logical + ext.length
+			last = last || ext.flags&fiemapExtentLast != 0
+		}
+		if last {
+			break
+		}
+	}
+
+	res.Ranges = mergeSectorRanges(res.Ranges)
+	return &res, nil
+}
+
+// ensureFileOnDevice returns error if the file doesn't belong to the
+// filesystem on the block device.
+func ensureFileOnDevice(path, device string) error {
+	var devStat, fileStat unix.Stat_t
+
+	if err := unix.Stat(device, &devStat); err != nil {
+		return fmt.Errorf("failed to stat device %s: %w", device, err)
+	}
+	if err := unix.Stat(path, &fileStat); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	if fileStat.Dev != devStat.Rdev {
+		return fmt.Errorf("file %s is not on device %s (dev %d:%d)", path, device,
+			unix.Major(fileStat.Dev), unix.Minor(fileStat.Dev))
+	}
+	return nil
+}
+
+// FS_IOC_FIEMAP and flags in include/uapi/linux/fiemap.h.
+const (
+	fsIocFiemap = 0xC020660B
+
+	fiemapExtentLast       = 0x00000001
+	fiemapExtentUnknown    = 0x00000002
+	fiemapExtentDelalloc   = 0x00000004
+	fiemapExtentDataInline = 0x00000200
+
+	fiemapExtentCount = 256
+)
+
+// fiemap is struct fiemap in include/uapi/linux/fiemap.h.
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+}
+
+// fiemapExtent is struct fiemap_extent in include/uapi/linux/fiemap.h.
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+// fiemapBuffer is struct fiemap followed by fm_extents.
+type fiemapBuffer struct {
+	hdr     fiemap
+	extents [fiemapExtentCount]fiemapExtent
+}
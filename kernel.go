@@ -0,0 +1,194 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrUnsupportedByKernel is returned when the running kernel doesn't support
+// the dm-flakey feature.
+var ErrUnsupportedByKernel = errors.New("unsupported by kernel")
+
+// UnsupportedFeatureError records the feature and the running versions.
+type UnsupportedFeatureError struct {
+	// Feature is the name of dm-flakey feature.
+	Feature string
+	// Kernel is the running kernel release.
+	Kernel string
+	// Target is the running dm-flakey target version.
+	Target string
+	// Requires describes the minimal requirement.
+	Requires string
+}
+
+// Error implements error interface.
+func (e *UnsupportedFeatureError) Error() string {
+	return fmt.Sprintf("dm-flakey feature %s is %s (kernel %s, flakey target %s): requires %s",
+		e.Feature, ErrUnsupportedByKernel, e.Kernel, e.Target, e.Requires)
+}
+
+// Unwrap returns ErrUnsupportedByKernel.
+func (e *UnsupportedFeatureError) Unwrap() error {
+	return ErrUnsupportedByKernel
+}
+
+// featureRequirement is the minimal dm-flakey target version for one
+// feature. The kernel release is only used if the target version can't be
+// queried, since distro kernels might backport the target.
+type featureRequirement struct {
+	kernel version
+	target version
+}
+
+// featureRequirements lists features which are not available in all the
+// kernels supporting dm-flakey.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-flakey.html
+var featureRequirements = map[string]featureRequirement{
+	"error_reads":          {kernel: version{6, 6, 0}, target: version{1, 5, 0}},
+	"random_read_corrupt":  {kernel: version{6, 6, 0}, target: version{1, 5, 0}},
+	"random_write_corrupt": {kernel: version{6, 6, 0}, target: version{1, 5, 0}},
+}
+
+// runningVersions is the running kernel release and dm-flakey target
+// version. They are queried once per process.
+type runningVersions struct {
+	release   string
+	kernel    version
+	target    version
+	targetErr error
+	err       error
+}
+
+var (
+	runningVersionsOnce sync.Once
+	running             runningVersions
+)
+
+// getRunningVersions returns the running kernel release and dm-flakey target
+// version.
+func getRunningVersions() runningVersions {
+	runningVersionsOnce.Do(func() {
+		running = runningVersions{}
+
+		running.target, running.targetErr = getFlakeyTargetVersion()
+
+		var err error
+		running.release, running.kernel, err = getKernelVersion()
+		if err != nil && running.targetErr != nil {
+			running.err = errors.Join(running.targetErr, err)
+		}
+	})
+	return running
+}
+
+// checkFeatureSupport returns UnsupportedFeatureError if the running
+// dm-flakey target is too old to support the feature. The kernel release is
+// checked instead if the target version can't be queried.
+func checkFeatureSupport(feature string) error {
+	req, ok := featureRequirements[feature]
+	if !ok {
+		return nil
+	}
+
+	running := getRunningVersions()
+	if running.err != nil {
+		return running.err
+	}
+
+	if running.targetErr == nil {
+		if !running.target.less(req.target) {
+			return nil
+		}
+		return &UnsupportedFeatureError{
+			Feature:  feature,
+			Kernel:   running.release,
+			Target:   running.target.String(),
+			Requires: fmt.Sprintf("flakey target %s", req.target),
+		}
+	}
+
+	if !running.kernel.less(req.kernel) {
+		return nil
+	}
+	return &UnsupportedFeatureError{
+		Feature:  feature,
+		Kernel:   running.release,
+		Target:   "unknown",
+		Requires: fmt.Sprintf("kernel %s", req.kernel),
+	}
+}
+
+// version is the semantic version, like kernel release or device-mapper
+// target version.
+type version [3]int
+
+// parseVersion parses version string like 1.5.0, v1.5.0 or 6.6.0-rc1.
+//
+// Missing components are treated as zero.
+func parseVersion(s string) (version, error) {
+	var v version
+
+	s = strings.TrimPrefix(s, "v")
+	if idx := strings.IndexFunc(s, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9')
+	}); idx >= 0 {
+		s = s[:idx]
+	}
+
+	parts := strings.SplitN(s, ".", 3)
+	for i, part := range parts {
+		if part == "" {
+			if i == 0 {
+				return v, fmt.Errorf("invalid version %q", s)
+			}
+			break
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q: %w", s, err)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// less returns true if v is older than o.
+func (v version) less(o version) bool {
+	for i := range v {
+		if v[i] != o[i] {
+			return v[i] < o[i]
+		}
+	}
+	return false
+}
+
+// String returns version in major.minor.patch format.
+func (v version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// getKernelVersion returns the running kernel release.
+//
+// REF: https://man7.org/linux/man-pages/man2/uname.2.html
+func getKernelVersion() (string, version, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", version{}, fmt.Errorf("failed to get kernel release: %w", err)
+	}
+
+	release := unix.ByteSliceToString(uts.Release[:])
+	v, err := parseVersion(release)
+	if err != nil {
+		return "", version{}, fmt.Errorf("failed to parse kernel release: %w", err)
+	}
+	return release, v, nil
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected version
+		hasErr   bool
+	}{
+		{in: "v1.5.0", expected: version{1, 5, 0}},
+		{in: "6.6.0-rc1", expected: version{6, 6, 0}},
+		{in: "6.18.44-fc-v130", expected: version{6, 18, 44}},
+		{in: "5.15", expected: version{5, 15, 0}},
+		{in: "6.8.0+", expected: version{6, 8, 0}},
+		{in: "unknown", hasErr: true},
+	} {
+		v, err := parseVersion(tc.in)
+		if tc.hasErr {
+			assert.Error(t, err, tc.in)
+			continue
+		}
+		require.NoError(t, err, tc.in)
+		assert.Equal(t, tc.expected, v, tc.in)
+	}
+
+	assert.True(t, version{5, 15, 0}.less(version{6, 6, 0}))
+	assert.False(t, version{6, 6, 0}.less(version{6, 6, 0}))
+	assert.False(t, version{6, 18, 44}.less(version{6, 6, 0}))
+}
+
+func TestCheckFeatureSupport(t *testing.T) {
+	// backported target on old kernel
+	backend := &countingFlakeyBackend{target: version{1, 5, 0}}
+	defer useBackend(backend)()
+
+	assert.NoError(t, checkFeatureSupport("random_read_corrupt"))
+	assert.NoError(t, checkFeatureSupport("error_reads"))
+	assert.NoError(t, checkFeatureSupport("drop_writes"))
+	assert.Equal(t, 1, backend.calls, "target version is queried once")
+
+	// old target
+	defer useBackend(&countingFlakeyBackend{target: version{1, 4, 0}})()
+
+	err := checkFeatureSupport("error_reads")
+	require.ErrorIs(t, err, ErrUnsupportedByKernel)
+	assert.ErrorContains(t, err, "requires flakey target 1.5.0")
+
+	// fall back to kernel release
+	defer useBackend(&countingFlakeyBackend{err: errors.New("no control device")})()
+
+	_, kernel, err := getKernelVersion()
+	require.NoError(t, err)
+
+	err = checkFeatureSupport("error_reads")
+	if kernel.less(version{6, 6, 0}) {
+		require.ErrorIs(t, err, ErrUnsupportedByKernel)
+		assert.ErrorContains(t, err, "requires kernel 6.6.0")
+	} else {
+		assert.NoError(t, err)
+	}
+}
+
+// countingFlakeyBackend reports the flakey target version and counts the
+// queries.
+type countingFlakeyBackend struct {
+	dmBackend
+
+	target version
+	err    error
+	calls  int
+}
+
+func (b *countingFlakeyBackend) targetVersion(string) (version, error) {
+	b.calls++
+	return b.target, b.err
+}
@@ -0,0 +1,456 @@
+//go:build linux
+
+// Package loop manages loop devices by ioctl.
+//
+// REF: https://man7.org/linux/man-pages/man4/loop.4.html
+package loop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ControlDevice is the loop control device.
+	ControlDevice = "/dev/loop-control"
+
+	devicePattern = "/dev/loop%d"
+
+	// major is LOOP_MAJOR.
+	major = 7
+
+	maxRetryToAttach = 50
+
+	// minBackoff and maxBackoff bound the wait after the free loop device
+	// is taken by others.
+	minBackoff = 10 * time.Millisecond
+	maxBackoff = time.Second
+)
+
+// ErrNoFreeDevice is returned if all the loop devices are in use and the
+// pool can't grow, for instance, it reaches Config.MaxDevices.
+var ErrNoFreeDevice = errors.New("no free loop device")
+
+// loopConfigure is LOOP_CONFIGURE, which is missing in x/sys. It's supported
+// since Linux 5.8.
+const loopConfigure = 0x4C0A
+
+// loopConfig is struct loop_config.
+type loopConfig struct {
+	Fd        uint32
+	BlockSize uint32
+	Info      unix.LoopInfo64
+	_         [8]uint64
+}
+
+// Config configures the loop device.
+type Config struct {
+	// ReadOnly makes the loop device read-only.
+	ReadOnly bool
+	// DirectIO accesses the backing file with direct I/O so that the
+	// data isn't cached twice, in both the loop device and the backing
+	// file. The kernel falls back to buffered I/O if the backing file
+	// doesn't support it. Check Info.DirectIO after Attach.
+	DirectIO bool
+	// AutoClear detaches the loop device when the last opener closes it.
+	AutoClear bool
+	// BlockSize is the logical block size in bytes. Zero means 512.
+	BlockSize uint32
+	// Offset is the start of data in backing file in bytes.
+	Offset uint64
+	// SizeLimit is the max size of the loop device in bytes. Zero means
+	// up to the end of backing file.
+	SizeLimit uint64
+	// MaxDevices caps the loop device pool. Attach only uses or adds the
+	// loop device whose index is less than it. Zero means no cap, and the
+	// kernel adds new loop device if there is no free one.
+	MaxDevices int
+}
+
+// AttachStats is the statistics of Attach, used to measure the contention of
+// loop devices.
+type AttachStats struct {
+	// Attempts is the number of free loop devices tried.
+	Attempts int
+	// Busy is the number of attempts failed because the free loop device
+	// was taken by others.
+	Busy int
+	// Added is the number of loop devices added by LOOP_CTL_ADD.
+	Added int
+}
+
+// flags returns LO_FLAGS_* of config.
+func (cfg Config) flags() uint32 {
+	var flags uint32
+	if cfg.ReadOnly {
+		flags |= unix.LO_FLAGS_READ_ONLY
+	}
+	if cfg.DirectIO {
+		flags |= unix.LO_FLAGS_DIRECT_IO
+	}
+	if cfg.AutoClear {
+		flags |= unix.LO_FLAGS_AUTOCLEAR
+	}
+	return flags
+}
+
+// Info is the status of loop device.
+type Info struct {
+	// Number is the index of loop device.
+	Number int
+	// BackingFile is the backing file name, which might be truncated to
+	// 63 bytes by kernel.
+	BackingFile string
+	// Device and Inode are the device number and inode of backing file.
+	Device, Inode uint64
+	// Offset and SizeLimit are in bytes.
+	Offset, SizeLimit uint64
+	// ReadOnly, AutoClear, PartScan and DirectIO are the active flags.
+	ReadOnly, AutoClear, PartScan, DirectIO bool
+	// BlockSize is the logical block size in bytes.
+	BlockSize uint32
+}
+
+// Attach associates free loop device with backing file and returns the
+// opened loop device. The caller must close it. If Config.AutoClear is true,
+// the loop device is detached once it's closed by all the openers.
+//
+// It uses LOOP_CONFIGURE if the kernel supports it. Otherwise, it falls back
+// to LOOP_SET_FD followed by LOOP_SET_STATUS64, LOOP_SET_BLOCK_SIZE and
+// LOOP_SET_DIRECT_IO.
+func Attach(backingFile string, cfg Config) (*os.File, error) {
+	loopFd, _, err := AttachWithStats(backingFile, cfg)
+	return loopFd, err
+}
+
+// AttachWithStats is like Attach but also returns the statistics.
+//
+// There might have race condition that the free loop device is taken by
+// others. It retries with randomized exponential backoff when it runs into
+// EBUSY. If Config.MaxDevices is set, it probes the loop devices under the
+// cap and grows the pool by LOOP_CTL_ADD, or returns ErrNoFreeDevice without
+// retry if all of them are in use. Otherwise, it uses LOOP_CTL_GET_FREE,
+// which adds new loop device by itself if there is no free one.
+func AttachWithStats(backingFile string, cfg Config) (_ *os.File, stats AttachStats, _ error) {
+	mode := os.O_RDWR
+	if cfg.ReadOnly {
+		mode = os.O_RDONLY
+	}
+
+	backingFd, err := os.OpenFile(backingFile, mode, 0)
+	if err != nil {
+		return nil, stats, fmt.Errorf("failed to open loop device's backing file %s: %w",
+			backingFile, err)
+	}
+	defer backingFd.Close()
+
+	backoff := minBackoff
+	for stats.Attempts < maxRetryToAttach {
+		stats.Attempts++
+
+		loop, added, err := getFree(cfg.MaxDevices)
+		if added {
+			stats.Added++
+		}
+		if err != nil {
+			return nil, stats, fmt.Errorf("failed to get free loop device (attempts: %d): %w",
+				stats.Attempts, err)
+		}
+
+		loopFd, err := os.OpenFile(loop, mode, 0)
+		if err != nil {
+			return nil, stats, fmt.Errorf("failed to open loop %s: %w", loop, err)
+		}
+
+		if err := configure(int(loopFd.Fd()), backingFd, cfg); err != nil {
+			loopFd.Close()
+
+			if errors.Is(err, unix.EBUSY) {
+				stats.Busy++
+
+				// NOTE: Randomize the wait so that the racers don't
+				// pick up the same loop device again.
+				time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+				if backoff *= 2; backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+			return nil, stats, fmt.Errorf("failed to attach %s to %s: %w", backingFile, loop, err)
+		}
+		return loopFd, stats, nil
+	}
+	return nil, stats, fmt.Errorf("failed to associate free loop device with backing file %s (attempts: %d): %w",
+		backingFile, stats.Attempts, unix.EBUSY)
+}
+
+// configure associates the loop device with backing file by config.
+func configure(loopFd int, backing *os.File, cfg Config) error {
+	lc := loopConfig{Fd: uint32(backing.Fd()), BlockSize: cfg.BlockSize}
+	lc.Info.Offset = cfg.Offset
+	lc.Info.Sizelimit = cfg.SizeLimit
+	lc.Info.Flags = cfg.flags()
+	// NOTE: The kernel doesn't fill the file name like losetup.
+	copy(lc.Info.File_name[:unix.LO_NAME_SIZE-1], backing.Name())
+
+	if !supportsLoopConfigure(loopFd) {
+		return configureLegacy(loopFd, backing, cfg)
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(loopFd), loopConfigure, uintptr(unsafe.Pointer(&lc)))
+	if errno != 0 {
+		return fmt.Errorf("LOOP_CONFIGURE (block size: %d, offset: %d, size limit: %d, flags: %#x): %w",
+			cfg.BlockSize, cfg.Offset, cfg.SizeLimit, cfg.flags(), errno)
+	}
+	return nil
+}
+
+var (
+	loopConfigureOnce      sync.Once
+	loopConfigureSupported bool
+)
+
+// supportsLoopConfigure returns true if the kernel supports LOOP_CONFIGURE.
+// It's probed once by invalid backing file descriptor, which the kernel
+// supporting it rejects with EBADF without touching the loop device. The old
+// kernel returns EINVAL or ENOTTY for unknown ioctl.
+func supportsLoopConfigure(loopFd int) bool {
+	loopConfigureOnce.Do(func() {
+		lc := loopConfig{Fd: math.MaxUint32}
+
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(loopFd), loopConfigure, uintptr(unsafe.Pointer(&lc)))
+		loopConfigureSupported = errno != unix.EINVAL && errno != unix.ENOTTY
+	})
+	return loopConfigureSupported
+}
+
+// configureLegacy associates the loop device with backing file by multiple
+// ioctls. The device is detached if any of them fails.
+func configureLegacy(loopFd int, backing *os.File, cfg Config) (retErr error) {
+	if err := unix.IoctlSetInt(loopFd, unix.LOOP_SET_FD, int(backing.Fd())); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = unix.IoctlSetInt(loopFd, unix.LOOP_CLR_FD, 0)
+		}
+	}()
+
+	info, err := unix.IoctlLoopGetStatus64(loopFd)
+	if err != nil {
+		return fmt.Errorf("failed to get status: %w", err)
+	}
+
+	info.Offset = cfg.Offset
+	info.Sizelimit = cfg.SizeLimit
+	if cfg.AutoClear {
+		info.Flags |= unix.LO_FLAGS_AUTOCLEAR
+	}
+	copy(info.File_name[:unix.LO_NAME_SIZE-1], backing.Name())
+	if err := unix.IoctlLoopSetStatus64(loopFd, info); err != nil {
+		return fmt.Errorf("failed to set status: %w", err)
+	}
+
+	if cfg.BlockSize != 0 {
+		if err := unix.IoctlSetInt(loopFd, unix.LOOP_SET_BLOCK_SIZE, int(cfg.BlockSize)); err != nil {
+			return fmt.Errorf("failed to set block size %d: %w", cfg.BlockSize, err)
+		}
+	}
+
+	if cfg.DirectIO {
+		if err := unix.IoctlSetInt(loopFd, unix.LOOP_SET_DIRECT_IO, 1); err != nil {
+			return fmt.Errorf("failed to enable direct I/O: %w", err)
+		}
+	}
+	return nil
+}
+
+// Detach disassociates the loop device from any backing file. If the loop
+// device is still opened, the kernel defers it until the last close.
+func Detach(device string) error {
+	loopFd, err := os.Open(device)
+	if err != nil {
+		return fmt.Errorf("failed to open loop %s: %w", device, err)
+	}
+	defer loopFd.Close()
+
+	return unix.IoctlSetInt(int(loopFd.Fd()), unix.LOOP_CLR_FD, 0)
+}
+
+// GetInfo returns the status of loop device by LOOP_GET_STATUS64.
+func GetInfo(device string) (*Info, error) {
+	loopFd, err := os.Open(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open loop %s: %w", device, err)
+	}
+	defer loopFd.Close()
+
+	status, err := unix.IoctlLoopGetStatus64(int(loopFd.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status of loop %s: %w", device, err)
+	}
+
+	info := &Info{
+		Number:      int(status.Number),
+		BackingFile: cString(status.File_name[:]),
+		Device:      status.Device,
+		Inode:       status.Inode,
+		Offset:      status.Offset,
+		SizeLimit:   status.Sizelimit,
+		ReadOnly:    status.Flags&unix.LO_FLAGS_READ_ONLY != 0,
+		AutoClear:   status.Flags&unix.LO_FLAGS_AUTOCLEAR != 0,
+		PartScan:    status.Flags&unix.LO_FLAGS_PARTSCAN != 0,
+		DirectIO:    status.Flags&unix.LO_FLAGS_DIRECT_IO != 0,
+	}
+
+	// NOTE: The block size isn't in loop_info64.
+	blockSize, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(device), "queue/logical_block_size"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get block size of loop %s: %w", device, err)
+	}
+
+	size, err := strconv.ParseUint(strings.TrimSpace(string(blockSize)), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse block size of loop %s: %w", device, err)
+	}
+	info.BlockSize = uint32(size)
+	return info, nil
+}
+
+// GetFree allocates or finds a free loop device for use. The device node is
+// created if udev doesn't create it, like in container.
+func GetFree() (string, error) {
+	device, _, err := getFree(0)
+	return device, err
+}
+
+// getFree returns the free loop device. It's true if the loop device is
+// added by LOOP_CTL_ADD.
+//
+// If maxDevices is zero, it uses LOOP_CTL_GET_FREE, which returns the free
+// loop device with the lowest index or adds new one if there is no free one.
+// Otherwise, it probes the loop devices whose index is less than maxDevices,
+// so that the pool never grows beyond the cap.
+func getFree(maxDevices int) (_ string, added bool, _ error) {
+	control, err := os.OpenFile(ControlDevice, os.O_RDWR, 0)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to open %s: %w", ControlDevice, err)
+	}
+	defer control.Close()
+
+	var idx int
+	if maxDevices > 0 {
+		idx, added, err = probeFree(int(control.Fd()), maxDevices)
+	} else {
+		idx, err = unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	device := fmt.Sprintf(devicePattern, idx)
+	if err := ensureDeviceNode(device, deviceNumber(idx)); err != nil {
+		return "", added, err
+	}
+	return device, added, nil
+}
+
+// probeFree returns the index of the free loop device with the lowest index
+// less than limit. If the index isn't used, it adds the loop device by
+// LOOP_CTL_ADD and returns true.
+func probeFree(controlFd, limit int) (_ int, added bool, _ error) {
+	for idx := 0; idx < limit; idx++ {
+		err := unix.IoctlSetInt(controlFd, unix.LOOP_CTL_ADD, idx)
+		switch {
+		case err == nil:
+			return idx, true, nil
+		case !errors.Is(err, unix.EEXIST):
+			return 0, false, fmt.Errorf("failed to add loop device %d: %w", idx, err)
+		}
+
+		free, err := isFree(idx)
+		if err != nil {
+			return 0, false, err
+		}
+		if free {
+			return idx, false, nil
+		}
+	}
+	return 0, false, fmt.Errorf("%w: all the %d loop devices are in use", ErrNoFreeDevice, limit)
+}
+
+// isFree returns true if the loop device has no backing file.
+func isFree(idx int) (bool, error) {
+	device := fmt.Sprintf(devicePattern, idx)
+	if err := ensureDeviceNode(device, deviceNumber(idx)); err != nil {
+		return false, err
+	}
+
+	loopFd, err := os.Open(device)
+	if err != nil {
+		return false, fmt.Errorf("failed to open loop %s: %w", device, err)
+	}
+	defer loopFd.Close()
+
+	_, err = unix.IoctlLoopGetStatus64(int(loopFd.Fd()))
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.Is(err, unix.ENXIO):
+		return true, nil
+	default:
+		return false, fmt.Errorf("failed to get status of loop %s: %w", device, err)
+	}
+}
+
+// deviceNumber returns the device number of loop device by index. It reads
+// sysfs because the minor is shifted if max_part is set. Otherwise, it's
+// LOOP_MAJOR:index.
+func deviceNumber(idx int) uint64 {
+	data, err := os.ReadFile(fmt.Sprintf("/sys/block/loop%d/dev", idx))
+	if err == nil {
+		var maj, min uint32
+		if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d:%d", &maj, &min); err == nil {
+			return unix.Mkdev(maj, min)
+		}
+	}
+	return unix.Mkdev(major, uint32(idx))
+}
+
+// ensureDeviceNode creates the block device node if it doesn't exist. The
+// node with different device number or dangling symlink is replaced, since it
+// might be left by the device removed without udev.
+func ensureDeviceNode(node string, dev uint64) error {
+	var st unix.Stat_t
+	if err := unix.Stat(node, &st); err == nil && st.Mode&unix.S_IFMT == unix.S_IFBLK && st.Rdev == dev {
+		return nil
+	}
+
+	if err := os.Remove(node); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale node %s: %w", node, err)
+	}
+	if err := unix.Mknod(node, unix.S_IFBLK|0660, int(dev)); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to create device node %s: %w", node, err)
+	}
+	return nil
+}
+
+// cString returns the string before the first NUL.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,265 @@
+//go:build linux
+
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getuid() != 0 {
+		fmt.Fprintln(os.Stderr, "This test must be run as root.")
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestAttach(t *testing.T) {
+	img := createImage(t, 16<<20)
+
+	f, err := Attach(img, Config{
+		DirectIO:  true,
+		BlockSize: 4096,
+		Offset:    1 << 20,
+		SizeLimit: 8 << 20,
+	})
+	require.NoError(t, err)
+	defer f.Close()
+	defer Detach(f.Name())
+
+	info, err := GetInfo(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, img, info.BackingFile)
+	assert.Equal(t, uint64(1<<20), info.Offset)
+	assert.Equal(t, uint64(8<<20), info.SizeLimit)
+	assert.Equal(t, uint32(4096), info.BlockSize)
+	assert.False(t, info.ReadOnly)
+	assert.False(t, info.AutoClear)
+
+	size, err := unix.IoctlGetInt(int(f.Fd()), unix.BLKSSZGET)
+	require.NoError(t, err)
+	assert.Equal(t, 4096, size)
+
+	// detach is deferred until the last close
+	require.NoError(t, Detach(f.Name()))
+	require.NoError(t, f.Close())
+
+	_, err = GetInfo(f.Name())
+	assert.True(t, errors.Is(err, unix.ENXIO))
+}
+
+func TestAttachInvalidConfig(t *testing.T) {
+	img := createImage(t, 16<<20)
+
+	// fallback to legacy ioctls is only for the kernel without
+	// LOOP_CONFIGURE, not for the invalid config.
+	_, err := Attach(img, Config{BlockSize: 1000})
+	require.ErrorIs(t, err, unix.EINVAL)
+	assert.ErrorContains(t, err, "LOOP_CONFIGURE (block size: 1000")
+}
+
+func TestAttachReadOnlyAutoClear(t *testing.T) {
+	img := createImage(t, 16<<20)
+
+	f, err := Attach(img, Config{ReadOnly: true, AutoClear: true})
+	require.NoError(t, err)
+
+	info, err := GetInfo(f.Name())
+	require.NoError(t, err)
+	assert.True(t, info.ReadOnly)
+	assert.True(t, info.AutoClear)
+	assert.Equal(t, uint32(512), info.BlockSize)
+
+	_, err = f.Write([]byte("hello"))
+	assert.Error(t, err)
+
+	// autoclear detaches it after the last close
+	require.NoError(t, f.Close())
+
+	_, err = GetInfo(f.Name())
+	assert.True(t, errors.Is(err, unix.ENXIO))
+}
+
+func TestConfigureLegacy(t *testing.T) {
+	img := createImage(t, 16<<20)
+
+	backing, err := os.OpenFile(img, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer backing.Close()
+
+	loop, err := GetFree()
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(loop, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, configureLegacy(int(f.Fd()), backing, Config{
+		AutoClear: true,
+		BlockSize: 4096,
+		Offset:    1 << 20,
+		SizeLimit: 8 << 20,
+	}))
+
+	info, err := GetInfo(loop)
+	require.NoError(t, err)
+	assert.Equal(t, img, info.BackingFile)
+	assert.Equal(t, uint64(1<<20), info.Offset)
+	assert.Equal(t, uint64(8<<20), info.SizeLimit)
+	assert.Equal(t, uint32(4096), info.BlockSize)
+	assert.True(t, info.AutoClear)
+
+	// the device is detached if any step fails
+	require.NoError(t, f.Close())
+
+	f, err = os.OpenFile(loop, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.Error(t, configureLegacy(int(f.Fd()), backing, Config{BlockSize: 1000}))
+
+	_, err = GetInfo(loop)
+	assert.True(t, errors.Is(err, unix.ENXIO))
+}
+
+func TestAttachMaxDevices(t *testing.T) {
+	f, stats, err := AttachWithStats(createImage(t, 16<<20), Config{AutoClear: true})
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Equal(t, 1, stats.Attempts)
+	assert.Equal(t, 0, stats.Busy)
+
+	// leave one unused index at least so that the pool has to grow
+	maxDevices := 0
+	for {
+		if _, err := os.Stat(fmt.Sprintf("/sys/block/loop%d", maxDevices)); err != nil {
+			break
+		}
+		maxDevices++
+	}
+	maxDevices++
+
+	var added int
+	for i := 0; ; i++ {
+		require.LessOrEqual(t, i, maxDevices, "attach more than cap")
+
+		f, stats, err := AttachWithStats(createImage(t, 16<<20), Config{AutoClear: true, MaxDevices: maxDevices})
+		if err != nil {
+			require.ErrorIs(t, err, ErrNoFreeDevice)
+			assert.Equal(t, 1, stats.Attempts)
+			break
+		}
+		defer f.Close()
+		added += stats.Added
+
+		info, err := GetInfo(f.Name())
+		require.NoError(t, err)
+		assert.Less(t, info.Number, maxDevices)
+	}
+	assert.GreaterOrEqual(t, added, 1)
+
+	// no loop device is added beyond the cap
+	_, err = os.Stat(fmt.Sprintf("/sys/block/loop%d", maxDevices))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestAttachConcurrently(t *testing.T) {
+	const n = 16
+
+	var (
+		wg    sync.WaitGroup
+		files = make([]*os.File, n)
+		stats = make([]AttachStats, n)
+		errs  = make([]error, n)
+	)
+	for i := 0; i < n; i++ {
+		img := createImage(t, 16<<20)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			files[i], stats[i], errs[i] = AttachWithStats(img, Config{AutoClear: true})
+		}(i)
+	}
+	wg.Wait()
+
+	devices := map[string]bool{}
+	for i := 0; i < n; i++ {
+		require.NoError(t, errs[i])
+		defer files[i].Close()
+
+		assert.False(t, devices[files[i].Name()], "%s is attached twice", files[i].Name())
+		devices[files[i].Name()] = true
+		assert.Equal(t, stats[i].Busy+1, stats[i].Attempts)
+		t.Logf("%s: %+v", files[i].Name(), stats[i])
+	}
+}
+
+func TestGetFreeWithoutNode(t *testing.T) {
+	device, err := GetFree()
+	require.NoError(t, err)
+
+	// remove node like udev isn't running
+	require.NoError(t, os.Remove(device))
+
+	again, err := GetFree()
+	require.NoError(t, err)
+	assert.Equal(t, device, again)
+
+	fi, err := os.Stat(device)
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeDevice)
+
+	f, err := Attach(createImage(t, 16<<20), Config{AutoClear: true})
+	require.NoError(t, err)
+	assert.Equal(t, device, f.Name())
+	require.NoError(t, f.Close())
+}
+
+func TestEnsureDeviceNode(t *testing.T) {
+	var (
+		node = filepath.Join(t.TempDir(), "loop")
+		dev  = unix.Mkdev(major, 1024)
+	)
+
+	assertNode := func() {
+		var st unix.Stat_t
+		require.NoError(t, unix.Stat(node, &st))
+		assert.Equal(t, uint32(unix.S_IFBLK), st.Mode&unix.S_IFMT)
+		assert.Equal(t, dev, st.Rdev)
+	}
+
+	require.NoError(t, ensureDeviceNode(node, dev))
+	assertNode()
+
+	// stale node with different device number
+	require.NoError(t, os.Remove(node))
+	require.NoError(t, unix.Mknod(node, unix.S_IFBLK|0660, int(unix.Mkdev(major, 1025))))
+	require.NoError(t, ensureDeviceNode(node, dev))
+	assertNode()
+
+	// dangling symlink
+	require.NoError(t, os.Remove(node))
+	require.NoError(t, os.Symlink("dm-1024", node))
+	require.NoError(t, ensureDeviceNode(node, dev))
+	assertNode()
+}
+
+func createImage(t *testing.T, size int64) string {
+	img := filepath.Join(t.TempDir(), "loop.img")
+
+	f, err := os.Create(img)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(size))
+	require.NoError(t, f.Close())
+	return img
+}
@@ -0,0 +1,278 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// MetadataKind represents the kind of filesystem metadata region.
+type MetadataKind string
+
+// Supported metadata kinds.
+const (
+	// MetadataSuperblock is ext4 primary and backup superblocks.
+	MetadataSuperblock MetadataKind = "superblock"
+	// MetadataGroupDescriptors is ext4 group descriptors, including
+	// reserved GDT blocks.
+	MetadataGroupDescriptors MetadataKind = "group-descriptors"
+	// MetadataBitmaps is ext4 block and inode bitmaps.
+	MetadataBitmaps MetadataKind = "bitmaps"
+	// MetadataInodeTable is ext4 inode tables.
+	MetadataInodeTable MetadataKind = "inode-table"
+	// MetadataJournal is ext4 jbd2 journal or XFS internal log.
+	MetadataJournal MetadataKind = "journal"
+	// MetadataAGHeaders is XFS allocation group headers, including
+	// superblock, AGF, AGI and AGFL.
+	MetadataAGHeaders MetadataKind = "ag-headers"
+)
+
+// MetadataRegion is one well-known metadata region on the flakey device.
+type MetadataRegion struct {
+	Kind  MetadataKind
+	Range SectorRange
+}
+
+// MetadataRegions is a list of metadata regions.
+type MetadataRegions []MetadataRegion
+
+// Ranges returns the merged sector ranges of the given kinds. All the kinds
+// are included if there is no kind.
+func (regions MetadataRegions) Ranges(kinds ...MetadataKind) []SectorRange {
+	wanted := make(map[MetadataKind]bool, len(kinds))
+	for _, kind := range kinds {
+		wanted[kind] = true
+	}
+
+	var ranges []SectorRange
+	for _, region := range regions {
+		if len(kinds) == 0 || wanted[region.Kind] {
+			ranges = append(ranges, region.Range)
+		}
+	}
+	return mergeSectorRanges(ranges)
+}
+
+// GetMetadataRegions returns the well-known metadata regions of filesystem
+// on the flakey device.
+//
+// For ext4, it parses the output of dumpe2fs(8) and debugfs(8). For XFS, it
+// parses the primary superblock directly.
+func GetMetadataRegions(f Flakey) (MetadataRegions, error) {
+	switch fsType := f.Filesystem(); fsType {
+	case FSTypeEXT4:
+		return getExt4MetadataRegions(f.DevicePath())
+	case FSTypeXFS:
+		return getXFSMetadataRegions(f.DevicePath())
+	default:
+		return nil, fmt.Errorf("unsupported filesystem %s", fsType)
+	}
+}
+
+var (
+	ext4BlockSizeRegex    = regexp.MustCompile(`^Block size:\s+(\d+)`)
+	ext4JournalInodeRegex = regexp.MustCompile(`^Journal inode:\s+(\d+)`)
+	ext4GroupRegionRegex  = regexp.MustCompile(`(Primary superblock|Backup superblock|Group descriptors|Reserved GDT blocks|Block bitmap|Inode bitmap|Inode table) at (\d+)(?:-(\d+))?`)
+	ext4ExtentRegex       = regexp.MustCompile(`\([^)]*\):(\d+)(?:-(\d+))?`)
+)
+
+var ext4RegionKinds = map[string]MetadataKind{
+	"Primary superblock":  MetadataSuperblock,
+	"Backup superblock":   MetadataSuperblock,
+	"Group descriptors":   MetadataGroupDescriptors,
+	"Reserved GDT blocks": MetadataGroupDescriptors,
+	"Block bitmap":        MetadataBitmaps,
+	"Inode bitmap":        MetadataBitmaps,
+	"Inode table":         MetadataInodeTable,
+}
+
+// getExt4MetadataRegions parses dumpe2fs(8) for group layout and debugfs(8)
+// for journal inode's blocks.
+//
+// REF: https://man7.org/linux/man-pages/man8/dumpe2fs.8.html
+// REF: https://man7.org/linux/man-pages/man8/debugfs.8.html
+func getExt4MetadataRegions(device string) (MetadataRegions, error) {
+	output, err := exec.Command("dumpe2fs", device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dumpe2fs %s: %w", device, err)
+	}
+
+	var (
+		blockSize    int64
+		journalInode string
+		regions      MetadataRegions
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if m := ext4BlockSizeRegex.FindStringSubmatch(line); m != nil {
+			blockSize, _ = strconv.ParseInt(m[1], 10, 64)
+			continue
+		}
+		if m := ext4JournalInodeRegex.FindStringSubmatch(line); m != nil {
+			journalInode = m[1]
+			continue
+		}
+
+		for _, m := range ext4GroupRegionRegex.FindAllStringSubmatch(line, -1) {
+			if blockSize == 0 {
+				return nil, fmt.Errorf("failed to find block size in dumpe2fs %s", device)
+			}
+			regions = append(regions, MetadataRegion{
+				Kind:  ext4RegionKinds[m[1]],
+				Range: blocksToSectorRange(m[2], m[3], blockSize),
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse dumpe2fs %s: %w", device, err)
+	}
+
+	if journalInode == "" {
+		return regions, nil
+	}
+
+	output, err = exec.Command("debugfs", "-R", fmt.Sprintf("stat <%s>", journalInode), device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat journal inode %s on %s: %w", journalInode, device, err)
+	}
+
+	// The blocks are listed at the end, like "EXTENTS:\n(0-16383):1081344-1097727".
+	blocks := -1
+	for _, header := range []string{"EXTENTS:", "BLOCKS:"} {
+		if idx := bytes.LastIndex(output, []byte(header)); idx >= 0 {
+			blocks = idx + len(header)
+			break
+		}
+	}
+	if blocks < 0 {
+		return nil, fmt.Errorf("failed to find journal inode %s blocks on %s (out: %s)",
+			journalInode, device, string(output))
+	}
+
+	for _, m := range ext4ExtentRegex.FindAllStringSubmatch(string(output[blocks:]), -1) {
+		regions = append(regions, MetadataRegion{
+			Kind:  MetadataJournal,
+			Range: blocksToSectorRange(m[1], m[2], blockSize),
+		})
+	}
+	return regions, nil
+}
+
+// blocksToSectorRange converts [first, last] filesystem blocks to sector range.
+// The last is optional.
+func blocksToSectorRange(first, last string, blockSize int64) SectorRange {
+	start, _ := strconv.ParseInt(first, 10, 64)
+	end := start
+	if last != "" {
+		end, _ = strconv.ParseInt(last, 10, 64)
+	}
+
+	sectorsPerBlock := blockSize / SectorSize
+	return SectorRange{
+		Start:  start * sectorsPerBlock,
+		Length: (end - start + 1) * sectorsPerBlock,
+	}
+}
+
+// xfsSuperblock is part of struct xfs_dsb in fs/xfs/libxfs/xfs_format.h.
+// All the fields are big-endian.
+type xfsSuperblock struct {
+	MagicNum   uint32
+	BlockSize  uint32
+	DBlocks    uint64
+	RBlocks    uint64
+	RExtents   uint64
+	UUID       [16]byte
+	LogStart   uint64
+	RootIno    uint64
+	RBMIno     uint64
+	RSumIno    uint64
+	RExtSize   uint32
+	AGBlocks   uint32
+	AGCount    uint32
+	RBMBlocks  uint32
+	LogBlocks  uint32
+	VersionNum uint16
+	SectSize   uint16
+	InodeSize  uint16
+	InoPBlock  uint16
+	FName      [12]byte
+	BlockLog   uint8
+	SectLog    uint8
+	InodeLog   uint8
+	InoPBLog   uint8
+	AGBlkLog   uint8
+}
+
+// xfsMagic is XFS_SB_MAGIC, "XFSB".
+const xfsMagic = 0x58465342
+
+// getXFSMetadataRegions parses XFS primary superblock for allocation group
+// headers and internal log.
+//
+// REF: fs/xfs/libxfs/xfs_format.h
+func getXFSMetadataRegions(device string) (MetadataRegions, error) {
+	dev, err := os.Open(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %s: %w", device, err)
+	}
+	defer dev.Close()
+
+	var sb xfsSuperblock
+	if err := binary.Read(dev, binary.BigEndian, &sb); err != nil {
+		return nil, fmt.Errorf("failed to read xfs superblock from %s: %w", device, err)
+	}
+	return xfsMetadataRegions(&sb)
+}
+
+// xfsMetadataRegions returns allocation group headers and internal log
+// regions described by superblock.
+func xfsMetadataRegions(sb *xfsSuperblock) (MetadataRegions, error) {
+	if sb.MagicNum != xfsMagic {
+		return nil, fmt.Errorf("invalid xfs superblock magic number 0x%x", sb.MagicNum)
+	}
+	if sb.BlockSize == 0 || sb.SectSize == 0 || sb.BlockSize%SectorSize != 0 {
+		return nil, fmt.Errorf("invalid xfs block size %d or sector size %d",
+			sb.BlockSize, sb.SectSize)
+	}
+
+	var (
+		regions         MetadataRegions
+		sectorsPerBlock = int64(sb.BlockSize / SectorSize)
+		sectorsPerAG    = int64(sb.AGBlocks) * sectorsPerBlock
+	)
+
+	// Each allocation group starts with superblock, AGF, AGI and AGFL.
+	agHeaderSectors := 4 * int64(sb.SectSize) / SectorSize
+	for agno := int64(0); agno < int64(sb.AGCount); agno++ {
+		regions = append(regions, MetadataRegion{
+			Kind:  MetadataAGHeaders,
+			Range: SectorRange{Start: agno * sectorsPerAG, Length: agHeaderSectors},
+		})
+	}
+
+	// Zero sb_logstart means the log is external.
+	if sb.LogStart != 0 {
+		agno := int64(sb.LogStart >> sb.AGBlkLog)
+		agbno := int64(sb.LogStart & (1<<sb.AGBlkLog - 1))
+
+		regions = append(regions, MetadataRegion{
+			Kind: MetadataJournal,
+			Range: SectorRange{
+				Start:  agno*sectorsPerAG + agbno*sectorsPerBlock,
+				Length: int64(sb.LogBlocks) * sectorsPerBlock,
+			},
+		})
+	}
+	return regions, nil
+}
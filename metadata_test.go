@@ -0,0 +1,80 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExt4MetadataRegions(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "ext4.img")
+
+	f, err := os.Create(img)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(1024*1024*1024))
+	require.NoError(t, f.Close())
+
+	output, err := exec.Command("mkfs.ext4", "-b", "4096", img).CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	regions, err := getExt4MetadataRegions(img)
+	require.NoError(t, err)
+
+	// primary superblock is in block 0
+	sbs := regions.Ranges(MetadataSuperblock)
+	require.NotEmpty(t, sbs)
+	assert.Equal(t, SectorRange{Start: 0, Length: 8}, sbs[0])
+
+	for _, kind := range []MetadataKind{
+		MetadataGroupDescriptors,
+		MetadataBitmaps,
+		MetadataInodeTable,
+		MetadataJournal,
+	} {
+		assert.NotEmpty(t, regions.Ranges(kind), "kind %s", kind)
+	}
+
+	// journal doesn't overlap with other metadata
+	journal := regions.Ranges(MetadataJournal)
+	others := regions.Ranges(MetadataSuperblock, MetadataGroupDescriptors,
+		MetadataBitmaps, MetadataInodeTable)
+	assert.Equal(t, journal, subtractSectorRanges(journal, others))
+}
+
+func TestXFSMetadataRegions(t *testing.T) {
+	sb := &xfsSuperblock{
+		MagicNum:  xfsMagic,
+		BlockSize: 4096,
+		SectSize:  512,
+		AGBlocks:  1 << 16,
+		AGCount:   4,
+		AGBlkLog:  16,
+		// the log is in the 2nd allocation group, offset 16 blocks
+		LogStart:  1<<16 | 16,
+		LogBlocks: 2560,
+	}
+
+	regions, err := xfsMetadataRegions(sb)
+	require.NoError(t, err)
+
+	assert.Equal(t, []SectorRange{
+		{Start: 0, Length: 4},
+		{Start: 1 << 19, Length: 4},
+		{Start: 2 << 19, Length: 4},
+		{Start: 3 << 19, Length: 4},
+	}, regions.Ranges(MetadataAGHeaders))
+
+	assert.Equal(t, []SectorRange{
+		{Start: 1<<19 + 16*8, Length: 2560 * 8},
+	}, regions.Ranges(MetadataJournal))
+
+	sb.MagicNum = 0
+	_, err = xfsMetadataRegions(sb)
+	assert.Error(t, err)
+}
@@ -0,0 +1,446 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Scenario describes a fault campaign in JSON, for example:
+//
+//	{
+//	  "device": {"name": "wal", "fsType": "ext4", "size": "1GiB", "mountOptions": "commit=1000"},
+//	  "steps": [
+//	    {"action": "error_writes", "duration": "5s"},
+//	    {"action": "allow"},
+//	    {"action": "corrupt", "corrupt": {"direction": "r", "nth": 1, "value": 255, "flags": ["meta"]}},
+//	    {"action": "wait", "duration": "10s"},
+//	    {"action": "power-failure"}
+//	  ]
+//	}
+type Scenario struct {
+	Device ScenarioDevice `json:"device"`
+	Steps  []ScenarioStep `json:"steps"`
+}
+
+// ScenarioDevice describes the flakey device for scenario.
+type ScenarioDevice struct {
+	// Name is the device-mapper device name.
+	Name string `json:"name"`
+	// FSType is the filesystem type.
+	FSType FSType `json:"fsType"`
+	// Size is the size of filesystem image. Default is 10 GiB.
+	Size ByteSize `json:"size,omitempty"`
+	// BlockSize is the logical block size, like 4KiB to emulate 4K native
+	// drive. Default is 512 bytes.
+	BlockSize ByteSize `json:"blockSize,omitempty"`
+	// MountOptions is used to mount the filesystem, like commit=1000, by
+	// Scenario.Mount and the remount of power-failure action.
+	MountOptions string `json:"mountOptions,omitempty"`
+}
+
+// ScenarioAction is the kind of scenario step.
+type ScenarioAction string
+
+// Supported scenario actions.
+const (
+	// ActionAllow makes the device healthy.
+	ActionAllow ScenarioAction = "allow"
+	// ActionDropWrites drops all write I/O silently.
+	ActionDropWrites ScenarioAction = "drop_writes"
+	// ActionErrorWrites fails all write I/O.
+	ActionErrorWrites ScenarioAction = "error_writes"
+	// ActionErrorReads fails all read I/O.
+	ActionErrorReads ScenarioAction = "error_reads"
+	// ActionOffline fails all read and write I/O.
+	ActionOffline ScenarioAction = "offline"
+	// ActionCorrupt corrupts read or write bio.
+	ActionCorrupt ScenarioAction = "corrupt"
+	// ActionWait keeps the current state for duration.
+	ActionWait ScenarioAction = "wait"
+	// ActionPowerFailure drops unsynced writes by unmounting the filesystem
+	// with drop_writes, and then mounts it again.
+	ActionPowerFailure ScenarioAction = "power-failure"
+)
+
+// ScenarioStep is one step of scenario. The step keeps its state for
+// Duration before the next step.
+type ScenarioStep struct {
+	Action   ScenarioAction   `json:"action"`
+	Duration Duration         `json:"duration,omitempty"`
+	Corrupt  *ScenarioCorrupt `json:"corrupt,omitempty"`
+}
+
+// ScenarioCorrupt is the argument of corrupt action.
+//
+// If Probability is set, it's random_read_corrupt or random_write_corrupt
+// based on direction, and Nth, Value and Flags must be empty. Otherwise, it's
+// corrupt_bio_byte.
+type ScenarioCorrupt struct {
+	Direction   BIODirection `json:"direction"`
+	Nth         int          `json:"nth,omitempty"`
+	Value       uint8        `json:"value,omitempty"`
+	Flags       []string     `json:"flags,omitempty"`
+	Probability int          `json:"probability,omitempty"`
+}
+
+// bioFlagNames maps the lowercase REQ_* names without prefix to BIOFlag.
+var bioFlagNames = map[string]BIOFlag{
+	"failfast_dev":       BIOFlagFailFastDev,
+	"failfast_transport": BIOFlagFailFastTransport,
+	"failfast_driver":    BIOFlagFailFastDriver,
+	"sync":               BIOFlagSync,
+	"meta":               BIOFlagMeta,
+	"prio":               BIOFlagPrio,
+	"nomerge":            BIOFlagNoMerge,
+	"idle":               BIOFlagIdle,
+	"integrity":          BIOFlagIntegrity,
+	"fua":                BIOFlagFUA,
+	"preflush":           BIOFlagPreflush,
+	"rahead":             BIOFlagRahead,
+	"background":         BIOFlagBackground,
+}
+
+// feature returns the corruption feature.
+func (c *ScenarioCorrupt) feature() (Feature, error) {
+	if err := validateBIODirection(c.Direction); err != nil {
+		return nil, err
+	}
+
+	if c.Probability != 0 {
+		if c.Nth != 0 || c.Value != 0 || len(c.Flags) != 0 {
+			return nil, fmt.Errorf("nth, value and flags can't be used with probability")
+		}
+		if c.Direction == BIORead {
+			return RandomReadCorruptFeature{Probability: c.Probability}, nil
+		}
+		return RandomWriteCorruptFeature{Probability: c.Probability}, nil
+	}
+
+	var flags BIOFlag
+	for _, name := range c.Flags {
+		flag, ok := bioFlagNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported bio flag %q", name)
+		}
+		flags |= flag
+	}
+	return CorruptBIOByteFeature{Nth: c.Nth, Direction: c.Direction, Value: c.Value, Flags: flags}, nil
+}
+
+// spec returns the fault spec for action. It returns false if the action
+// doesn't reload the device.
+func (step *ScenarioStep) spec() (FaultSpec, bool, error) {
+	var features []Feature
+
+	switch step.Action {
+	case ActionAllow:
+	case ActionDropWrites:
+		features = append(features, DropWritesFeature{})
+	case ActionErrorWrites:
+		features = append(features, ErrorWritesFeature{})
+	case ActionErrorReads:
+		features = append(features, ErrorReadsFeature{})
+	case ActionOffline:
+		var o = defaultFeatCfg
+		spec := o.offlineSpec()
+		return spec, true, spec.validate()
+	case ActionCorrupt:
+		if step.Corrupt == nil {
+			return FaultSpec{}, false, fmt.Errorf("corrupt action requires corrupt argument")
+		}
+
+		feat, err := step.Corrupt.feature()
+		if err != nil {
+			return FaultSpec{}, false, err
+		}
+		features = append(features, feat)
+	case ActionWait, ActionPowerFailure:
+		return FaultSpec{}, false, nil
+	default:
+		return FaultSpec{}, false, fmt.Errorf("unsupported action %q", step.Action)
+	}
+
+	var o = defaultFeatCfg
+	spec := o.spec(features...)
+	return spec, true, spec.validate()
+}
+
+// LoadScenario decodes and validates scenario in JSON.
+func LoadScenario(r io.Reader) (*Scenario, error) {
+	var sc Scenario
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sc); err != nil {
+		return nil, fmt.Errorf("failed to decode scenario: %w", err)
+	}
+
+	if err := sc.Validate(); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// LoadScenarioFile decodes and validates scenario file in JSON.
+func LoadScenarioFile(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scenario %s: %w", path, err)
+	}
+	defer f.Close()
+
+	return LoadScenario(f)
+}
+
+// Validate validates the device and steps.
+func (sc *Scenario) Validate() error {
+	if sc.Device.Name == "" {
+		return fmt.Errorf("device name is required")
+	}
+	if err := validateFSType(sc.Device.FSType); err != nil {
+		return err
+	}
+	if sc.Device.Size < 0 {
+		return fmt.Errorf("invalid negative device size %d", sc.Device.Size)
+	}
+	if sc.Device.BlockSize != 0 {
+		if err := validateBlockSize(int(sc.Device.BlockSize), 0); err != nil {
+			return err
+		}
+	}
+
+	for i := range sc.Steps {
+		step := &sc.Steps[i]
+
+		if step.Duration < 0 {
+			return fmt.Errorf("invalid step %d (%s): negative duration %v", i, step.Action, step.Duration)
+		}
+		if step.Action == ActionWait && step.Duration == 0 {
+			return fmt.Errorf("invalid step %d (%s): duration is required", i, step.Action)
+		}
+		if _, _, err := step.spec(); err != nil {
+			return fmt.Errorf("invalid step %d (%s): %w", i, step.Action, err)
+		}
+	}
+	return nil
+}
+
+// InitFlakey creates the flakey device described by scenario.
+func (sc *Scenario) InitFlakey(dataStorePath string) (Flakey, error) {
+	var opts []InitOpt
+	if sc.Device.Size > 0 {
+		opts = append(opts, WithImgSizeInitOpt(int64(sc.Device.Size)))
+	}
+	if sc.Device.BlockSize > 0 {
+		opts = append(opts, WithBlockSizeInitOpt(int(sc.Device.BlockSize), 0))
+	}
+	return InitFlakey(sc.Device.Name, dataStorePath, sc.Device.FSType, opts...)
+}
+
+// Mount mounts the filesystem on flakey device at mountPoint with
+// MountOptions of device.
+func (sc *Scenario) Mount(f Flakey, mountPoint string) error {
+	return mountFS(f, mountPoint, sc.Device.MountOptions)
+}
+
+// ScenarioReport is the result of scenario.
+type ScenarioReport struct {
+	Steps []StepReport `json:"steps"`
+}
+
+// StepReport is the result of one step.
+type StepReport struct {
+	Index    int            `json:"index"`
+	Action   ScenarioAction `json:"action"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// Run runs the steps in order against the flakey device whose filesystem is
+// mounted at mountPoint. It stops at the first failed step or when context is
+// canceled. The context also aborts the in-flight transition, like stuck
+// suspend.
+//
+// The mountPoint is only used by power-failure action. Mount the filesystem
+// by Scenario.Mount so that MountOptions applies to every mount.
+func (sc *Scenario) Run(ctx context.Context, f Flakey, mountPoint string) (*ScenarioReport, error) {
+	report := &ScenarioReport{}
+
+	for i := range sc.Steps {
+		step := &sc.Steps[i]
+
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		res := StepReport{Index: i, Action: step.Action, Started: time.Now()}
+		err := sc.runStep(ctx, f, mountPoint, step)
+		res.Finished = time.Now()
+		if err != nil {
+			res.Error = err.Error()
+		}
+		report.Steps = append(report.Steps, res)
+
+		if err != nil {
+			return report, fmt.Errorf("failed to run step %d (%s): %w", i, step.Action, err)
+		}
+	}
+	return report, nil
+}
+
+// runStep applies the step and keeps it for duration.
+func (sc *Scenario) runStep(ctx context.Context, f Flakey, mountPoint string, step *ScenarioStep) error {
+	spec, reload, err := step.spec()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case reload:
+		err = f.Apply(spec, WithContextFeatOpt(ctx))
+	case step.Action == ActionPowerFailure:
+		err = powerFailure(ctx, f, mountPoint, sc.Device.MountOptions)
+	}
+	if err != nil {
+		return err
+	}
+
+	if step.Duration == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(step.Duration))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// powerFailure drops all the unsynced writes by unmounting filesystem with
+// drop_writes, and then mounts it again.
+func powerFailure(ctx context.Context, f Flakey, mountPoint string, mountOptions string) error {
+	if mountPoint == "" {
+		return fmt.Errorf("mount point is required")
+	}
+
+	if err := f.DropWrites(WithContextFeatOpt(ctx)); err != nil {
+		return fmt.Errorf("failed to drop_writes: %w", err)
+	}
+
+	if err := unmountFS(mountPoint); err != nil {
+		return err
+	}
+
+	if err := f.AllowWrites(WithContextFeatOpt(ctx)); err != nil {
+		return fmt.Errorf("failed to allow_writes: %w", err)
+	}
+
+	return mountFS(f, mountPoint, mountOptions)
+}
+
+// mountFS mounts the filesystem on flakey device at mountPoint.
+func mountFS(f Flakey, mountPoint string, mountOptions string) error {
+	if err := unix.Mount(f.DevicePath(), mountPoint, string(f.Filesystem()), 0, mountOptions); err != nil {
+		return fmt.Errorf("failed to mount %s on %s: %w", f.DevicePath(), mountPoint, err)
+	}
+	return nil
+}
+
+// unmountFS unmounts target and retries if it's busy.
+func unmountFS(target string) error {
+	for i := 0; i < 50; i++ {
+		err := unix.Unmount(target, 0)
+		switch {
+		case err == nil, errors.Is(err, unix.EINVAL):
+			return nil
+		case errors.Is(err, unix.EBUSY):
+			time.Sleep(500 * time.Millisecond)
+		default:
+			return fmt.Errorf("failed to umount %s: %w", target, err)
+		}
+	}
+	return fmt.Errorf("failed to umount %s: %w", target, unix.EBUSY)
+}
+
+// Duration is time.Duration in JSON string format, like "1.5s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be string like \"1.5s\": %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ByteSize is size in bytes. In JSON, it's a number or string with binary
+// unit, like "512MiB" or "10GiB".
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"B", 1},
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be number or string like \"10GiB\": %w", err)
+	}
+
+	unit := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: %w", string(data), err)
+	}
+	*b = ByteSize(v * unit)
+	return nil
+}
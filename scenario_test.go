@@ -0,0 +1,88 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadScenario(t *testing.T) {
+	sc, err := LoadScenarioFile("testdata/scenario.json")
+	require.NoError(t, err)
+
+	assert.Equal(t, ScenarioDevice{
+		Name:         "go-dmflakey-scenario",
+		FSType:       FSTypeEXT4,
+		Size:         1 << 30,
+		MountOptions: "commit=1000",
+	}, sc.Device)
+	require.Len(t, sc.Steps, 7)
+	assert.Equal(t, Duration(50*time.Millisecond), sc.Steps[1].Duration)
+
+	for name, content := range map[string]string{
+		"unknown field":          `{"device": {"name": "a", "fsType": "ext4"}, "steps": [{"action": "allow", "foo": 1}]}`,
+		"unknown action":         `{"device": {"name": "a", "fsType": "ext4"}, "steps": [{"action": "explode"}]}`,
+		"no name":                `{"device": {"fsType": "ext4"}}`,
+		"unknown fs":             `{"device": {"name": "a", "fsType": "btrfs"}}`,
+		"invalid size":           `{"device": {"name": "a", "fsType": "ext4", "size": "10GB"}}`,
+		"bad block size":         `{"device": {"name": "a", "fsType": "ext4", "blockSize": "3KiB"}}`,
+		"wait forever":           `{"device": {"name": "a", "fsType": "ext4"}, "steps": [{"action": "wait"}]}`,
+		"bad duration":           `{"device": {"name": "a", "fsType": "ext4"}, "steps": [{"action": "wait", "duration": 10}]}`,
+		"no corrupt":             `{"device": {"name": "a", "fsType": "ext4"}, "steps": [{"action": "corrupt"}]}`,
+		"bad flag":               `{"device": {"name": "a", "fsType": "ext4"}, "steps": [{"action": "corrupt", "corrupt": {"direction": "r", "nth": 1, "flags": ["x"]}}]}`,
+		"bad nth":                `{"device": {"name": "a", "fsType": "ext4"}, "steps": [{"action": "corrupt", "corrupt": {"direction": "r"}}]}`,
+		"nth with probability":   `{"device": {"name": "a", "fsType": "ext4"}, "steps": [{"action": "corrupt", "corrupt": {"direction": "r", "nth": 1, "probability": 100}}]}`,
+		"flags with probability": `{"device": {"name": "a", "fsType": "ext4"}, "steps": [{"action": "corrupt", "corrupt": {"direction": "w", "flags": ["meta"], "probability": 100}}]}`,
+	} {
+		_, err := LoadScenario(strings.NewReader(content))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestScenarioRun(t *testing.T) {
+	sc, err := LoadScenario(strings.NewReader(`{
+		"device": {"name": "a", "fsType": "ext4"},
+		"steps": [
+			{"action": "error_writes", "duration": "50ms"},
+			{"action": "allow"},
+			{"action": "offline"},
+			{"action": "corrupt", "corrupt": {"direction": "r", "nth": 1, "value": 255, "flags": ["meta", "sync"]}},
+			{"action": "wait", "duration": "50ms"},
+			{"action": "error_reads", "duration": "1h"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	f := &recordFlakey{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	report, err := sc.Run(ctx, f, "")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, report.Steps, 6)
+
+	for i, res := range report.Steps[:5] {
+		assert.Equal(t, i, res.Index)
+		assert.Equal(t, sc.Steps[i].Action, res.Action)
+		assert.Empty(t, res.Error)
+		assert.True(t, res.Finished.Sub(res.Started) >= time.Duration(sc.Steps[i].Duration))
+	}
+	assert.Contains(t, report.Steps[5].Error, context.DeadlineExceeded.Error())
+
+	assert.Equal(t, []FaultSpec{
+		{DownInterval: defaultInterval, Features: []Feature{ErrorWritesFeature{}}},
+		{UpInterval: defaultInterval},
+		{DownInterval: defaultInterval},
+		{DownInterval: defaultInterval, Features: []Feature{
+			CorruptBIOByteFeature{Nth: 1, Direction: BIORead, Value: 255, Flags: BIOFlagMeta | BIOFlagSync},
+		}},
+		{DownInterval: defaultInterval, Features: []Feature{ErrorReadsFeature{}}},
+	}, f.specs())
+}
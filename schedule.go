@@ -0,0 +1,172 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ScheduleStep is one transition in the timeline.
+type ScheduleStep struct {
+	// Offset is when the step is applied, relative to the start of timeline.
+	Offset time.Duration
+	// Spec is applied to the flakey device at Offset.
+	//
+	// The spec must stay in one state, either up or down. The interval can
+	// be less than one second because the next step takes over, and it's
+	// rounded up for dm-flakey.
+	Spec FaultSpec
+}
+
+// ScheduleEvent records the actual transition of one step.
+type ScheduleEvent struct {
+	// Step is the index of step in timeline.
+	Step int
+	// Spec is the applied spec.
+	Spec FaultSpec
+	// Scheduled is when the step is supposed to be applied.
+	Scheduled time.Time
+	// Started is when the reload is started.
+	Started time.Time
+	// Applied is when the reload is finished. The new table takes effect
+	// between Started and Applied.
+	Applied time.Time
+	// Err is the reload error.
+	Err error
+}
+
+// maxScheduleEvents is the number of latest events kept by Schedule, so that
+// the long-running schedule, like chaos, doesn't grow without limit.
+const maxScheduleEvents = 1024
+
+// Schedule runs a timeline of steps against the flakey device in a goroutine.
+type Schedule struct {
+	done chan struct{}
+
+	mu     sync.Mutex
+	events []ScheduleEvent
+	err    error
+}
+
+// StartSchedule validates steps and starts to apply them in order at
+// millisecond precision. The schedule stops when all the steps are applied,
+// one step fails or the context is canceled.
+//
+// Only WithSyncFSFeatOpt takes effect. The context is also used to abort the
+// in-flight transition.
+func StartSchedule(ctx context.Context, f Flakey, steps []ScheduleStep, opts ...FeatOpt) (*Schedule, error) {
+	steps = append([]ScheduleStep(nil), steps...)
+
+	var last time.Duration
+	for i, step := range steps {
+		if step.Offset < last {
+			return nil, fmt.Errorf("step %d offset %v is earlier than previous one %v",
+				i, step.Offset, last)
+		}
+		last = step.Offset
+
+		spec, err := steadySpec(step.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step %d: %w", i, err)
+		}
+		steps[i].Spec = spec
+	}
+
+	s := newSchedule()
+	go s.run(ctx, f, func(i int) (ScheduleStep, bool) {
+		if i >= len(steps) {
+			return ScheduleStep{}, false
+		}
+		return steps[i], true
+	}, opts...)
+	return s, nil
+}
+
+func newSchedule() *Schedule {
+	return &Schedule{done: make(chan struct{})}
+}
+
+// Done returns a channel that's closed when the schedule stops.
+func (s *Schedule) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait waits for the schedule to stop and returns the events. The error is
+// the first reload error or the context's error.
+func (s *Schedule) Wait() ([]ScheduleEvent, error) {
+	<-s.done
+	return s.Events(), s.err
+}
+
+// Events returns the events recorded so far. Only the latest 1024 events are
+// kept, and ScheduleEvent.Step tells the index of step.
+func (s *Schedule) Events() []ScheduleEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]ScheduleEvent(nil), s.events...)
+}
+
+// run applies the steps returned by next until there is no step.
+func (s *Schedule) run(ctx context.Context, f Flakey, next func(int) (ScheduleStep, bool), opts ...FeatOpt) {
+	defer close(s.done)
+
+	// NOTE: Don't append into opts, which might share the backing array
+	// with caller.
+	stepOpts := append(append([]FeatOpt(nil), opts...), WithContextFeatOpt(ctx))
+
+	start := time.Now()
+	for i := 0; ; i++ {
+		step, ok := next(i)
+		if !ok {
+			return
+		}
+
+		scheduled := start.Add(step.Offset)
+		timer := time.NewTimer(time.Until(scheduled))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.err = ctx.Err()
+			return
+		case <-timer.C:
+		}
+
+		ev := ScheduleEvent{Step: i, Spec: step.Spec, Scheduled: scheduled, Started: time.Now()}
+		ev.Err = f.Apply(step.Spec, stepOpts...)
+		ev.Applied = time.Now()
+
+		s.mu.Lock()
+		if len(s.events) >= maxScheduleEvents {
+			s.events = s.events[len(s.events)-maxScheduleEvents+1:]
+		}
+		s.events = append(s.events, ev)
+		s.mu.Unlock()
+
+		if ev.Err != nil {
+			s.err = fmt.Errorf("failed to apply step %d (%s): %w", i, step.Spec, ev.Err)
+			return
+		}
+	}
+}
+
+// steadySpec returns the spec which stays in one state with intervals
+// accepted by dm-flakey.
+//
+// dm-flakey never leaves the state if the other interval is zero, so that
+// the interval less than one second can be safely rounded up.
+func steadySpec(spec FaultSpec) (FaultSpec, error) {
+	switch {
+	case spec.UpInterval > 0 && spec.DownInterval > 0:
+		return spec, fmt.Errorf("spec must stay in up or down state, but got up %v and down %v",
+			spec.UpInterval, spec.DownInterval)
+	case spec.UpInterval > 0 && spec.UpInterval < time.Second:
+		spec.UpInterval = time.Second
+	case spec.DownInterval > 0 && spec.DownInterval < time.Second:
+		spec.DownInterval = time.Second
+	}
+	return spec, spec.validate()
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordFlakey records the applied specs without touching device.
+type recordFlakey struct {
+	Flakey
+
+	mu      sync.Mutex
+	applied []FaultSpec
+	err     error
+}
+
+func (f *recordFlakey) Apply(spec FaultSpec, _ ...FeatOpt) error {
+	if _, err := spec.args(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.applied = append(f.applied, spec)
+	return f.err
+}
+
+func (f *recordFlakey) specs() []FaultSpec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]FaultSpec(nil), f.applied...)
+}
+
+func TestSchedule(t *testing.T) {
+	f := &recordFlakey{}
+
+	steps := []ScheduleStep{
+		{Offset: 0, Spec: FaultSpec{DownInterval: 200 * time.Millisecond, Features: []Feature{ErrorWritesFeature{}}}},
+		{Offset: 200 * time.Millisecond, Spec: FaultSpec{UpInterval: 300 * time.Millisecond}},
+		{Offset: 500 * time.Millisecond, Spec: FaultSpec{DownInterval: time.Hour, Features: []Feature{DropWritesFeature{}}}},
+	}
+
+	start := time.Now()
+	s, err := StartSchedule(context.Background(), f, steps)
+	require.NoError(t, err)
+
+	events, err := s.Wait()
+	require.NoError(t, err)
+	require.Len(t, events, len(steps))
+
+	for i, ev := range events {
+		assert.Equal(t, i, ev.Step)
+		assert.NoError(t, ev.Err)
+		assert.False(t, ev.Started.Before(ev.Scheduled), "step %d started early", i)
+		assert.WithinDuration(t, start.Add(steps[i].Offset), ev.Started, 50*time.Millisecond, "step %d", i)
+	}
+
+	// sub-second intervals are rounded up for dm-flakey
+	assert.Equal(t, []FaultSpec{
+		{DownInterval: time.Second, Features: []Feature{ErrorWritesFeature{}}},
+		{UpInterval: time.Second},
+		steps[2].Spec,
+	}, f.specs())
+}
+
+func TestScheduleKeepsLatestEvents(t *testing.T) {
+	f := &recordFlakey{}
+
+	total := maxScheduleEvents + 10
+	steps := make([]ScheduleStep, total)
+	for i := range steps {
+		steps[i].Spec = FaultSpec{UpInterval: time.Second}
+	}
+
+	// opts has spare capacity, which must not be written by schedule.
+	opts := make([]FeatOpt, 1, 2)
+	opts[0] = WithSyncFSFeatOpt(false)
+
+	s, err := StartSchedule(context.Background(), f, steps, opts...)
+	require.NoError(t, err)
+
+	events, err := s.Wait()
+	require.NoError(t, err)
+	require.Len(t, events, maxScheduleEvents)
+	assert.Equal(t, total-maxScheduleEvents, events[0].Step)
+	assert.Equal(t, total-1, events[len(events)-1].Step)
+	assert.Len(t, f.specs(), total)
+
+	assert.Nil(t, opts[:2][1])
+}
+
+func TestScheduleCancel(t *testing.T) {
+	f := &recordFlakey{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := StartSchedule(ctx, f, []ScheduleStep{
+		{Offset: 0, Spec: FaultSpec{UpInterval: time.Minute}},
+		{Offset: time.Hour, Spec: FaultSpec{UpInterval: time.Minute}},
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(s.Events()) == 1
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+
+	events, err := s.Wait()
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, events, 1)
+}
+
+func TestScheduleReloadError(t *testing.T) {
+	f := &recordFlakey{err: errors.New("boom")}
+
+	s, err := StartSchedule(context.Background(), f, []ScheduleStep{
+		{Offset: 0, Spec: FaultSpec{UpInterval: time.Minute}},
+		{Offset: 0, Spec: FaultSpec{UpInterval: time.Minute}},
+	})
+	require.NoError(t, err)
+
+	events, err := s.Wait()
+	assert.ErrorContains(t, err, "boom")
+	require.Len(t, events, 1)
+	assert.ErrorContains(t, events[0].Err, "boom")
+}
+
+func TestScheduleInvalidSteps(t *testing.T) {
+	f := &recordFlakey{}
+
+	for _, steps := range [][]ScheduleStep{
+		{
+			{Offset: time.Second, Spec: FaultSpec{UpInterval: time.Minute}},
+			{Offset: 0, Spec: FaultSpec{UpInterval: time.Minute}},
+		},
+		{
+			{Offset: 0, Spec: FaultSpec{UpInterval: time.Minute, DownInterval: time.Minute}},
+		},
+		{
+			{Offset: 0, Spec: FaultSpec{}},
+		},
+	} {
+		_, err := StartSchedule(context.Background(), f, steps)
+		assert.Error(t, err)
+	}
+	assert.Empty(t, f.specs())
+}
@@ -0,0 +1,251 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is what the kernel is actually running for the flakey device.
+type Status struct {
+	// Name is the device-mapper device name.
+	Name string
+	// Suspended is true if the device is suspended.
+	Suspended bool
+	// LiveTable is true if the device has live table.
+	LiveTable bool
+	// InactiveTable is true if there is loaded but not activated table,
+	// for instance, the reload failed to resume.
+	InactiveTable bool
+	// OpenCount is the number of opener.
+	OpenCount int
+	// EventNumber is the event counter of device.
+	EventNumber uint32
+	// Major and Minor are the device number.
+	Major, Minor uint32
+	// Targets is the live table.
+	Targets []TargetStatus
+	// InactiveTargets is the inactive table if InactiveTable is true.
+	InactiveTargets []TargetStatus
+}
+
+// TargetStatus is one line of device-mapper table.
+type TargetStatus struct {
+	// Start is the first sector of the target.
+	Start int64
+	// Length is the number of sectors.
+	Length int64
+	// Type is the target type, like flakey, linear or error.
+	Type string
+	// Device is the underlying device in major:minor format. It's empty
+	// if the target has no underlying device.
+	Device string
+	// Offset is the start sector on the underlying device.
+	Offset int64
+	// UpInterval and DownInterval are only for flakey target.
+	UpInterval, DownInterval time.Duration
+	// Features are the active features of flakey target.
+	Features []Feature
+	// Params is the raw parameters of target.
+	Params string
+}
+
+// parseDeviceInfo parses the output of dmsetup info.
+//
+//	Name:              go-dmflakey
+//	State:             ACTIVE
+//	Read Ahead:        256
+//	Tables present:    LIVE & INACTIVE
+//	Open count:        1
+//	Event number:      0
+//	Major, minor:      253, 0
+//	Number of targets: 1
+func parseDeviceInfo(output string, status *Status) error {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch strings.TrimSpace(key) {
+		case "Name":
+			status.Name = value
+		case "State":
+			status.Suspended = strings.HasPrefix(value, "SUSPENDED")
+		case "Tables present":
+			status.LiveTable = strings.Contains(value, "LIVE")
+			status.InactiveTable = strings.Contains(value, "INACTIVE")
+		case "Open count":
+			status.OpenCount, err = strconv.Atoi(value)
+		case "Event number":
+			var n uint64
+			n, err = strconv.ParseUint(value, 10, 32)
+			status.EventNumber = uint32(n)
+		case "Major, minor":
+			_, err = fmt.Sscanf(value, "%d, %d", &status.Major, &status.Minor)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse %q in device info: %w", scanner.Text(), err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseTable parses device-mapper table, one target per line.
+func parseTable(table string) ([]TargetStatus, error) {
+	var targets []TargetStatus
+
+	for _, line := range strings.Split(table, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid table line %q", line)
+		}
+
+		var (
+			target = TargetStatus{Type: fields[2], Params: strings.Join(fields[3:], " ")}
+			err    error
+		)
+		if target.Start, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid start in table line %q: %w", line, err)
+		}
+		if target.Length, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid length in table line %q: %w", line, err)
+		}
+
+		switch target.Type {
+		case "flakey":
+			err = parseFlakeyParams(fields[3:], &target)
+		case "linear":
+			err = parseLinearParams(fields[3:], &target)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid table line %q: %w", line, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// parseLinearParams parses <dev> <offset>.
+func parseLinearParams(params []string, target *TargetStatus) error {
+	if len(params) != 2 {
+		return fmt.Errorf("linear requires 2 parameters, but got %d", len(params))
+	}
+
+	offset, err := strconv.ParseInt(params[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offset: %w", err)
+	}
+	target.Device, target.Offset = params[0], offset
+	return nil
+}
+
+// parseFlakeyParams parses <dev> <offset> <up interval> <down interval>
+// [<num_features> [<feature arguments>]].
+func parseFlakeyParams(params []string, target *TargetStatus) error {
+	if len(params) < 4 {
+		return fmt.Errorf("flakey requires at least 4 parameters, but got %d", len(params))
+	}
+
+	var nums [3]int64
+	for i, param := range params[1:4] {
+		n, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid parameter %q: %w", param, err)
+		}
+		nums[i] = n
+	}
+	target.Device, target.Offset = params[0], nums[0]
+	target.UpInterval = time.Duration(nums[1]) * time.Second
+	target.DownInterval = time.Duration(nums[2]) * time.Second
+
+	if len(params) == 4 {
+		return nil
+	}
+
+	numArgs, err := strconv.Atoi(params[4])
+	if err != nil {
+		return fmt.Errorf("invalid number of features %q: %w", params[4], err)
+	}
+	if numArgs != len(params)-5 {
+		return fmt.Errorf("expected %d feature arguments, but got %d", numArgs, len(params)-5)
+	}
+
+	target.Features, err = parseFeatures(params[5:])
+	return err
+}
+
+// parseFeatures parses dm-flakey feature arguments.
+func parseFeatures(args []string) ([]Feature, error) {
+	var features []Feature
+
+	for len(args) > 0 {
+		name, rest := args[0], args[1:]
+
+		var (
+			feat   Feature
+			used   int
+			err    error
+			number = func(i int) int {
+				if err != nil {
+					return 0
+				}
+				var n int
+				n, err = strconv.Atoi(rest[i])
+				return n
+			}
+		)
+
+		switch name {
+		case DropWritesFeature{}.Name():
+			feat = DropWritesFeature{}
+		case ErrorWritesFeature{}.Name():
+			feat = ErrorWritesFeature{}
+		case ErrorReadsFeature{}.Name():
+			feat = ErrorReadsFeature{}
+		case CorruptBIOByteFeature{}.Name():
+			if used = 4; len(rest) < used {
+				break
+			}
+			feat = CorruptBIOByteFeature{
+				Nth:       number(0),
+				Direction: BIODirection(rest[1]),
+				Value:     uint8(number(2)),
+				Flags:     BIOFlag(number(3)),
+			}
+		case RandomReadCorruptFeature{}.Name():
+			if used = 1; len(rest) < used {
+				break
+			}
+			feat = RandomReadCorruptFeature{Probability: number(0)}
+		case RandomWriteCorruptFeature{}.Name():
+			if used = 1; len(rest) < used {
+				break
+			}
+			feat = RandomWriteCorruptFeature{Probability: number(0)}
+		default:
+			return nil, fmt.Errorf("unknown feature %q", name)
+		}
+
+		if feat == nil {
+			return nil, fmt.Errorf("feature %s requires %d arguments", name, used)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid feature %s arguments: %w", name, err)
+		}
+
+		features = append(features, feat)
+		args = rest[used:]
+	}
+	return features, nil
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeviceInfo(t *testing.T) {
+	var status Status
+
+	require.NoError(t, parseDeviceInfo(`Name:              go-dmflakey
+State:             SUSPENDED
+Read Ahead:        256
+Tables present:    LIVE & INACTIVE
+Open count:        2
+Event number:      3
+Major, minor:      253, 1
+Number of targets: 1
+`, &status))
+
+	assert.Equal(t, Status{
+		Name:          "go-dmflakey",
+		Suspended:     true,
+		LiveTable:     true,
+		InactiveTable: true,
+		OpenCount:     2,
+		EventNumber:   3,
+		Major:         253,
+		Minor:         1,
+	}, status)
+
+	assert.Error(t, parseDeviceInfo("Open count: x\n", &status))
+}
+
+func TestParseTable(t *testing.T) {
+	spec := FaultSpec{
+		UpInterval:   10 * time.Second,
+		DownInterval: 5 * time.Second,
+		Features: []Feature{
+			DropWritesFeature{},
+			ErrorReadsFeature{},
+			CorruptBIOByteFeature{Nth: 32, Direction: BIORead, Value: 255, Flags: BIOFlagMeta},
+			RandomReadCorruptFeature{Probability: 100},
+		},
+		Ranges: []SectorRange{{Start: 100, Length: 200}},
+	}
+
+	table, err := buildFlakeyTable(1000, SectorSize, "7:0", spec)
+	require.NoError(t, err)
+
+	targets, err := parseTable(table + "\n")
+	require.NoError(t, err)
+	require.Len(t, targets, 3)
+
+	assert.Equal(t, TargetStatus{
+		Start: 0, Length: 100, Type: "linear", Device: "7:0", Offset: 0,
+		Params: "7:0 0",
+	}, targets[0])
+	assert.Equal(t, TargetStatus{
+		Start: 100, Length: 200, Type: "flakey", Device: "7:0", Offset: 100,
+		UpInterval:   spec.UpInterval,
+		DownInterval: spec.DownInterval,
+		Features:     spec.Features,
+		Params:       strings.Join(strings.Fields(strings.Split(table, "\n")[1])[3:], " "),
+	}, targets[1])
+	assert.Equal(t, "linear", targets[2].Type)
+	assert.Equal(t, int64(300), targets[2].Offset)
+
+	targets, err = parseTable("0 1000 error")
+	require.NoError(t, err)
+	assert.Equal(t, []TargetStatus{{Start: 0, Length: 1000, Type: "error"}}, targets)
+
+	for _, table := range []string{
+		"0 1000",
+		"x 1000 error",
+		"0 1000 flakey 7:0 0 0 60 2 drop_writes",
+		"0 1000 flakey 7:0 0 0 60 1 unknown",
+		"0 1000 flakey 7:0 0 0 60 2 corrupt_bio_byte 1",
+		"0 1000 flakey 7:0 0 0 60 2 random_read_corrupt x",
+	} {
+		_, err := parseTable(table)
+		assert.Error(t, err, table)
+	}
+}
@@ -0,0 +1,222 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/fuweid/go-dmflakey/dm"
+)
+
+// SectorSize is the size of sector used by device-mapper table.
+const SectorSize = dm.SectorSize
+
+// SectorRange is a range of 512-byte sectors on the flakey device.
+type SectorRange struct {
+	// Start is the first sector of the range.
+	Start int64
+	// Length is the number of sectors.
+	Length int64
+}
+
+// End returns the sector right after the range.
+func (r SectorRange) End() int64 {
+	return r.Start + r.Length
+}
+
+// String returns the range in [start, end) format.
+func (r SectorRange) String() string {
+	return fmt.Sprintf("[%d, %d)", r.Start, r.End())
+}
+
+// validate returns error if the range is empty, negative or overflows.
+func (r SectorRange) validate() error {
+	if r.Start < 0 || r.Length <= 0 || r.Length > math.MaxInt64-r.Start {
+		return fmt.Errorf("invalid sector range (start: %d, length: %d): must be non-negative, non-empty and not overflow",
+			r.Start, r.Length)
+	}
+	return nil
+}
+
+// normalizeSectorRanges sorts ranges and merges the adjacent ones. It returns
+// error if any range is empty, out of device or overlaps with others.
+func normalizeSectorRanges(devSize int64, ranges []SectorRange) ([]SectorRange, error) {
+	sorted := make([]SectorRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	merged := make([]SectorRange, 0, len(sorted))
+	for _, r := range sorted {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		if r.End() > devSize {
+			return nil, fmt.Errorf("invalid sector range %s: device has %d sectors", r, devSize)
+		}
+
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if r.Start < last.End() {
+				return nil, fmt.Errorf("sector range %s overlaps with %s", r, *last)
+			}
+			if r.Start == last.End() {
+				last.Length += r.Length
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+// mergeSectorRanges returns the sorted union of ranges.
+func mergeSectorRanges(ranges []SectorRange) []SectorRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	sorted := make([]SectorRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	merged := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start > last.End() {
+			merged = append(merged, r)
+			continue
+		}
+		if r.End() > last.End() {
+			last.Length = r.End() - last.Start
+		}
+	}
+	return merged
+}
+
+// subtractSectorRanges returns the parts of ranges not covered by excludes.
+// Both of them must be sorted and not overlapped.
+func subtractSectorRanges(ranges, excludes []SectorRange) []SectorRange {
+	var res []SectorRange
+	for _, r := range ranges {
+		start, end := r.Start, r.End()
+		for _, ex := range excludes {
+			if ex.End() <= start || ex.Start >= end {
+				continue
+			}
+			if ex.Start > start {
+				res = append(res, SectorRange{Start: start, Length: ex.Start - start})
+			}
+			start = ex.End()
+			if start >= end {
+				break
+			}
+		}
+		if start < end {
+			res = append(res, SectorRange{Start: start, Length: end - start})
+		}
+	}
+	return res
+}
+
+// buildErrorTable returns the device-mapper table which fails all the I/O,
+// like the device is unplugged.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/index.html
+func buildErrorTable(devSize int64) string {
+	return dm.Table{{Length: devSize, Target: dm.Error{}}}.String()
+}
+
+// buildFlakeyTable returns the device-mapper table for the spec.
+//
+// If the spec has no ranges and excludes, the whole device is covered by one
+// flakey target. Otherwise, the faulty ranges are covered by flakey targets and
+// the rest are covered by linear targets, one line per target.
+//
+// The boundaries of targets must be aligned to the logical block size in
+// bytes, otherwise the kernel rejects the table.
+//
+// REF: https://docs.kernel.org/admin-guide/device-mapper/dm-flakey.html
+// REF: https://docs.kernel.org/admin-guide/device-mapper/linear.html
+func buildFlakeyTable(devSize int64, blockSize int, loopDevice string, spec FaultSpec) (string, error) {
+	if err := spec.validate(); err != nil {
+		return "", err
+	}
+
+	flakey := func(start, length int64) dm.Entry {
+		return dm.Entry{
+			Start:  start,
+			Length: length,
+			Target: dm.Flakey{
+				Device:       loopDevice,
+				Offset:       start,
+				UpInterval:   spec.UpInterval,
+				DownInterval: spec.DownInterval,
+				Features:     spec.featureArgs(),
+			},
+		}
+	}
+
+	if len(spec.Ranges) == 0 && len(spec.Excludes) == 0 {
+		return dm.Table{flakey(0, devSize)}.String(), nil
+	}
+
+	ranges := []SectorRange{{Start: 0, Length: devSize}}
+	if len(spec.Ranges) > 0 {
+		var err error
+		ranges, err = normalizeSectorRanges(devSize, spec.Ranges)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(spec.Excludes) > 0 {
+		for _, r := range spec.Excludes {
+			if err := r.validate(); err != nil {
+				return "", fmt.Errorf("invalid excluded sector range: %w", err)
+			}
+			if r.End() > devSize {
+				return "", fmt.Errorf("invalid excluded sector range %s: device has %d sectors", r, devSize)
+			}
+		}
+		ranges = subtractSectorRanges(ranges, mergeSectorRanges(spec.Excludes))
+		if len(ranges) == 0 {
+			return "", fmt.Errorf("no sector is left after excluding %v", spec.Excludes)
+		}
+	}
+
+	var (
+		table dm.Table
+		next  int64
+	)
+	linear := func(start, end int64) {
+		if start < end {
+			table = append(table, dm.Entry{
+				Start:  start,
+				Length: end - start,
+				Target: dm.Linear{Device: loopDevice, Offset: start},
+			})
+		}
+	}
+
+	for _, r := range ranges {
+		linear(next, r.Start)
+		table = append(table, flakey(r.Start, r.Length))
+		next = r.End()
+	}
+	linear(next, devSize)
+
+	sectorsPerBlock := int64(blockSize / SectorSize)
+	for _, e := range table {
+		if e.Start%sectorsPerBlock != 0 || e.Length%sectorsPerBlock != 0 {
+			return "", fmt.Errorf("sector range [%d, %d) isn't aligned to logical block size %d",
+				e.Start, e.Start+e.Length, blockSize)
+		}
+	}
+	return table.String(), nil
+}
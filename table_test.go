@@ -0,0 +1,190 @@
+//go:build linux
+
+package dmflakey
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildFlakeyTable(t *testing.T) {
+	spec := FaultSpec{
+		DownInterval: time.Minute,
+		Features:     []Feature{ErrorReadsFeature{}},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		ranges   []SectorRange
+		excludes []SectorRange
+		expected string
+		hasErr   bool
+	}{
+		{
+			name:     "whole device",
+			expected: "0 1000 flakey /dev/loop0 0 0 60 1 error_reads",
+		},
+		{
+			name:   "middle",
+			ranges: []SectorRange{{Start: 100, Length: 200}},
+			expected: "0 100 linear /dev/loop0 0\n" +
+				"100 200 flakey /dev/loop0 100 0 60 1 error_reads\n" +
+				"300 700 linear /dev/loop0 300",
+		},
+		{
+			name:   "unsorted and adjacent",
+			ranges: []SectorRange{{Start: 900, Length: 100}, {Start: 0, Length: 10}, {Start: 10, Length: 10}},
+			expected: "0 20 flakey /dev/loop0 0 0 60 1 error_reads\n" +
+				"20 880 linear /dev/loop0 20\n" +
+				"900 100 flakey /dev/loop0 900 0 60 1 error_reads",
+		},
+		{
+			name:     "excludes",
+			excludes: []SectorRange{{Start: 0, Length: 8}, {Start: 500, Length: 100}},
+			expected: "0 8 linear /dev/loop0 0\n" +
+				"8 492 flakey /dev/loop0 8 0 60 1 error_reads\n" +
+				"500 100 linear /dev/loop0 500\n" +
+				"600 400 flakey /dev/loop0 600 0 60 1 error_reads",
+		},
+		{
+			name:     "ranges with excludes",
+			ranges:   []SectorRange{{Start: 100, Length: 200}},
+			excludes: []SectorRange{{Start: 50, Length: 100}, {Start: 250, Length: 10}},
+			expected: "0 150 linear /dev/loop0 0\n" +
+				"150 100 flakey /dev/loop0 150 0 60 1 error_reads\n" +
+				"250 10 linear /dev/loop0 250\n" +
+				"260 40 flakey /dev/loop0 260 0 60 1 error_reads\n" +
+				"300 700 linear /dev/loop0 300",
+		},
+		{
+			name:     "exclude all",
+			ranges:   []SectorRange{{Start: 100, Length: 200}},
+			excludes: []SectorRange{{Start: 0, Length: 1000}},
+			hasErr:   true,
+		},
+		{
+			name:   "overlap",
+			ranges: []SectorRange{{Start: 0, Length: 10}, {Start: 5, Length: 10}},
+			hasErr: true,
+		},
+		{
+			name:   "out of device",
+			ranges: []SectorRange{{Start: 990, Length: 20}},
+			hasErr: true,
+		},
+		{
+			name:   "empty",
+			ranges: []SectorRange{{Start: 10}},
+			hasErr: true,
+		},
+		{
+			name:   "overflow",
+			ranges: []SectorRange{{Start: 10, Length: math.MaxInt64}},
+			hasErr: true,
+		},
+		{
+			name:     "negative exclude",
+			excludes: []SectorRange{{Start: -8, Length: 16}},
+			hasErr:   true,
+		},
+		{
+			name:     "empty exclude",
+			excludes: []SectorRange{{Start: 8}},
+			hasErr:   true,
+		},
+		{
+			name:     "overflow exclude",
+			excludes: []SectorRange{{Start: 8, Length: math.MaxInt64}},
+			hasErr:   true,
+		},
+		{
+			name:     "exclude out of device",
+			excludes: []SectorRange{{Start: 990, Length: 20}},
+			hasErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := spec
+			spec.Ranges = tc.ranges
+			spec.Excludes = tc.excludes
+
+			table, err := buildFlakeyTable(1000, SectorSize, "/dev/loop0", spec)
+			if tc.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, table)
+		})
+	}
+}
+
+func TestBuildFlakeyTableAlignment(t *testing.T) {
+	spec := FaultSpec{
+		DownInterval: time.Minute,
+		Features:     []Feature{ErrorReadsFeature{}},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		ranges   []SectorRange
+		excludes []SectorRange
+		expected string
+		hasErr   bool
+	}{
+		{
+			name:   "aligned",
+			ranges: []SectorRange{{Start: 8, Length: 16}},
+			expected: "0 8 linear /dev/loop0 0\n" +
+				"8 16 flakey /dev/loop0 8 0 60 1 error_reads\n" +
+				"24 976 linear /dev/loop0 24",
+		},
+		{
+			name:   "unaligned start",
+			ranges: []SectorRange{{Start: 10, Length: 8}},
+			hasErr: true,
+		},
+		{
+			name:   "unaligned length",
+			ranges: []SectorRange{{Start: 8, Length: 10}},
+			hasErr: true,
+		},
+		{
+			name:     "unaligned exclude",
+			excludes: []SectorRange{{Start: 8, Length: 4}},
+			hasErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := spec
+			spec.Ranges = tc.ranges
+			spec.Excludes = tc.excludes
+
+			table, err := buildFlakeyTable(1000, 4096, "/dev/loop0", spec)
+			if tc.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, table)
+		})
+	}
+}
+
+func TestMergeSectorRanges(t *testing.T) {
+	assert.Nil(t, mergeSectorRanges(nil))
+
+	assert.Equal(t,
+		[]SectorRange{{Start: 0, Length: 30}, {Start: 100, Length: 8}},
+		mergeSectorRanges([]SectorRange{
+			{Start: 100, Length: 8},
+			{Start: 10, Length: 20},
+			{Start: 0, Length: 10},
+			{Start: 12, Length: 4},
+		}),
+	)
+}